@@ -5,10 +5,10 @@ import (
 	"github.com/op/go-logging"
 	"github.com/unioproject/tanglebeat/lib/multiapi"
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
 	"nanomsg.org/go-mangos"
 	"nanomsg.org/go-mangos/protocol/sub"
 	"nanomsg.org/go-mangos/transport/tcp"
-	"strings"
 	"sync"
 	"time"
 )
@@ -193,7 +193,7 @@ func (cmon *ConfirmationMonitor) openNanozmq(nanozmq string) mangos.Socket {
 func (cmon *ConfirmationMonitor) nanozmqLoop(sock mangos.Socket) {
 	var msg []byte
 	var err error
-	var msgSplit []string
+	var sn *zmqmsg.SnMsg
 	var bundle Hash
 
 	for {
@@ -202,12 +202,12 @@ func (cmon *ConfirmationMonitor) nanozmqLoop(sock mangos.Socket) {
 			cmon.log.Errorf("Confirmation monitor: '%v'. Will be polling only")
 			return
 		}
-		msgSplit = strings.Split(string(msg), " ")
-		if len(msgSplit) < 7 {
-			cmon.log.Errorf("Confirmation monitor: wrong msg format")
+		sn, err = zmqmsg.ParseSn(zmqmsg.Split(msg))
+		if err != nil {
+			cmon.log.Errorf("Confirmation monitor: wrong msg format: %v", err)
 			continue
 		}
-		bundle = Hash(msgSplit[6])
+		bundle = Hash(sn.Bundle)
 
 		cmon.Lock()
 		for b, bs := range cmon.bundles {
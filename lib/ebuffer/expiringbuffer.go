@@ -128,6 +128,20 @@ func (buf *ExpiringBuffer) NewEntry(data ...interface{}) {
 	buf.top.Touch()
 }
 
+// segments must be restored in the order from the oldest to the newest. Expired segments are ignored
+func (buf *ExpiringBuffer) RestoreSegment__(seg ExpiringSegment) bool {
+	if seg.IsExpired(buf.retentionPeriodMs) {
+		return false
+	}
+	empty := buf.isEmpty()
+	seg.SetPrev(buf.top)
+	buf.top = seg
+	if empty {
+		go buf.purgeLoop()
+	}
+	return true
+}
+
 func (buf *ExpiringBuffer) ForEachSegment__(callback func(seg ExpiringSegment) bool) {
 	for s := buf.top; s != nil; s = s.GetPrev() {
 		if !s.IsExpired(buf.retentionPeriodMs) {
@@ -171,6 +185,17 @@ func (seg *ExpiringSegmentBase) SetPrev(prev ExpiringSegment) {
 	seg.prev = prev
 }
 
+// returns creation and last touch time of the segment
+func (seg *ExpiringSegmentBase) GetTimes() (uint64, uint64) {
+	return seg.created, seg.lastTouch
+}
+
+// used to restore saved segments
+func (seg *ExpiringSegmentBase) SetTimes(created, lastTouch uint64) {
+	seg.created = created
+	seg.lastTouch = lastTouch
+}
+
 func (seg *ExpiringSegmentBase) Touch() {
 	seg.lastTouch = utils.UnixMsNow()
 }
@@ -1,6 +1,7 @@
 package nanomsg
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/op/go-logging"
@@ -16,6 +17,8 @@ type Publisher struct {
 	sock    mangos.Socket
 	url     string
 	log     *logging.Logger
+	ctx     context.Context
+	chDone  chan struct{}
 }
 
 func (p *Publisher) Errorf(format string, args ...interface{}) {
@@ -43,12 +46,16 @@ func (p *Publisher) Debugf(format string, args ...interface{}) {
 }
 
 // reads input stream of byte arrays and sends them to publish channel
-func NewPublisher(enabled bool, port int, bufflen int, localLog *logging.Logger) (*Publisher, error) {
+// When the context is cancelled, data already in the channel is sent and the socket is closed
+func NewPublisher(ctx context.Context, enabled bool, port int, bufflen int, localLog *logging.Logger) (*Publisher, error) {
 	ret := Publisher{
 		enabled: enabled,
 		log:     localLog,
+		ctx:     ctx,
+		chDone:  make(chan struct{}),
 	}
 	if !enabled {
+		close(ret.chDone)
 		return &ret, nil
 	}
 	var err error
@@ -65,26 +72,51 @@ func NewPublisher(enabled bool, port int, bufflen int, localLog *logging.Logger)
 	ret.Infof("Publisher: PUB socket listening on %v", ret.url)
 	go func() {
 		ret.loop()
-		ret.sock.Close()
+		_ = ret.sock.Close()
+		ret.Infof("Publisher: PUB socket on %v closed", ret.url)
+		close(ret.chDone)
 	}()
 	return &ret, nil
 }
 
 func (p *Publisher) loop() {
-	for data := range p.chIn {
-		err := p.sock.Send(data)
-		if err != nil {
-			p.Errorf("Nanomsg publisher of %v: %v", p.url, err)
+	for {
+		select {
+		case data := <-p.chIn:
+			p.send(data)
+		case <-p.ctx.Done():
+			for {
+				select {
+				case data := <-p.chIn:
+					p.send(data)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+func (p *Publisher) send(data []byte) {
+	err := p.sock.Send(data)
+	if err != nil {
+		p.Errorf("Nanomsg publisher of %v: %v", p.url, err)
+	}
+}
+
+// closed when publisher is stopped
+func (p *Publisher) Done() <-chan struct{} {
+	return p.chDone
+}
+
 func (p *Publisher) PublishData(data []byte) error {
 	if !p.enabled {
 		return nil
 	}
 	select {
 	case p.chIn <- data:
+	case <-p.chDone:
+		return fmt.Errorf("publisher at %v is stopped", p.url)
 	case <-time.After(5 * time.Second):
 		return fmt.Errorf("----- Timeout 5 sec on sending to publish channel at %v", p.url)
 	}
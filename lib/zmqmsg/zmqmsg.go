@@ -0,0 +1,263 @@
+package zmqmsg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Typed messages of IRI ZMQ stream (and of the tanglebeat hub output).
+// Messages are split by single spaces, field 0 is the topic.
+// Parsing is strict: number of fields, length of hashes and tags and trytes alphabet are checked
+
+const (
+	HashLen = 81
+	TagLen  = 27
+)
+
+// 'tx <hash> <address> <value> <obsoleteTag> <timestamp> <currentIndex> <lastIndex> <bundle> <trunk> <branch> <arrivalTime> <tag>'
+type TxMsg struct {
+	Hash         string
+	Address      string
+	Value        int64
+	ObsoleteTag  string
+	Timestamp    uint64
+	CurrentIndex int
+	LastIndex    int
+	Bundle       string
+	Trunk        string
+	Branch       string
+	ArrivalTime  uint64
+	Tag          string
+}
+
+// 'sn <milestoneIndex> <txHash> <address> <trunk> <branch> <bundle>'
+type SnMsg struct {
+	Index   int
+	TxHash  string
+	Address string
+	Trunk   string
+	Branch  string
+	Bundle  string
+}
+
+// 'lmi <previousIndex> <latestIndex>'
+type LmiMsg struct {
+	PrevIndex int
+	Index     int
+}
+
+// 'lmhs <milestoneHash>'
+type LmhsMsg struct {
+	Hash string
+}
+
+// 'seen <txHash> <timesSeen>', produced by the hub
+type SeenMsg struct {
+	TxHash    string
+	TimesSeen int
+}
+
+// Split splits raw message into fields
+func Split(msgData []byte) []string {
+	return strings.Split(string(msgData), " ")
+}
+
+// Parse returns *TxMsg, *SnMsg, *LmiMsg, *LmhsMsg or *SeenMsg depending on the topic.
+// For other topics it returns nil without error
+func Parse(msgSplit []string) (interface{}, error) {
+	if len(msgSplit) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	switch msgSplit[0] {
+	case "tx":
+		return ParseTx(msgSplit)
+	case "sn":
+		return ParseSn(msgSplit)
+	case "lmi":
+		return ParseLmi(msgSplit)
+	case "lmhs":
+		return ParseLmhs(msgSplit)
+	case "seen":
+		return ParseSeen(msgSplit)
+	}
+	return nil, nil
+}
+
+func ParseTx(msgSplit []string) (*TxMsg, error) {
+	if err := checkFields(msgSplit, "tx", 13); err != nil {
+		return nil, err
+	}
+	ret := &TxMsg{}
+	p := parser{msgSplit: msgSplit}
+	ret.Hash = p.trytes(1, HashLen)
+	ret.Address = p.trytes(2, HashLen)
+	ret.Value = p.int64(3)
+	ret.ObsoleteTag = p.trytes(4, TagLen)
+	ret.Timestamp = p.uint64(5)
+	ret.CurrentIndex = p.index(6)
+	ret.LastIndex = p.index(7)
+	ret.Bundle = p.trytes(8, HashLen)
+	ret.Trunk = p.trytes(9, HashLen)
+	ret.Branch = p.trytes(10, HashLen)
+	ret.ArrivalTime = p.uint64(11)
+	ret.Tag = p.trytes(12, TagLen)
+	if p.err != nil {
+		return nil, p.err
+	}
+	if ret.CurrentIndex > ret.LastIndex {
+		return nil, fmt.Errorf("tx: current index %v is greater than last index %v", ret.CurrentIndex, ret.LastIndex)
+	}
+	return ret, nil
+}
+
+func ParseSn(msgSplit []string) (*SnMsg, error) {
+	if err := checkFields(msgSplit, "sn", 7); err != nil {
+		return nil, err
+	}
+	ret := &SnMsg{}
+	p := parser{msgSplit: msgSplit}
+	ret.Index = p.index(1)
+	ret.TxHash = p.trytes(2, HashLen)
+	ret.Address = p.trytes(3, HashLen)
+	ret.Trunk = p.trytes(4, HashLen)
+	ret.Branch = p.trytes(5, HashLen)
+	ret.Bundle = p.trytes(6, HashLen)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ret, nil
+}
+
+func ParseLmi(msgSplit []string) (*LmiMsg, error) {
+	if err := checkFields(msgSplit, "lmi", 3); err != nil {
+		return nil, err
+	}
+	ret := &LmiMsg{}
+	p := parser{msgSplit: msgSplit}
+	ret.PrevIndex = p.index(1)
+	ret.Index = p.index(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ret, nil
+}
+
+func ParseLmhs(msgSplit []string) (*LmhsMsg, error) {
+	if err := checkFields(msgSplit, "lmhs", 2); err != nil {
+		return nil, err
+	}
+	p := parser{msgSplit: msgSplit}
+	ret := &LmhsMsg{Hash: p.trytes(1, HashLen)}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ret, nil
+}
+
+func ParseSeen(msgSplit []string) (*SeenMsg, error) {
+	if err := checkFields(msgSplit, "seen", 3); err != nil {
+		return nil, err
+	}
+	ret := &SeenMsg{}
+	p := parser{msgSplit: msgSplit}
+	ret.TxHash = p.trytes(1, HashLen)
+	ret.TimesSeen = p.index(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ret, nil
+}
+
+func (msg *TxMsg) Split() []string {
+	return []string{
+		"tx",
+		msg.Hash,
+		msg.Address,
+		strconv.FormatInt(msg.Value, 10),
+		msg.ObsoleteTag,
+		strconv.FormatUint(msg.Timestamp, 10),
+		strconv.Itoa(msg.CurrentIndex),
+		strconv.Itoa(msg.LastIndex),
+		msg.Bundle,
+		msg.Trunk,
+		msg.Branch,
+		strconv.FormatUint(msg.ArrivalTime, 10),
+		msg.Tag,
+	}
+}
+
+func (msg *SeenMsg) Split() []string {
+	return []string{"seen", msg.TxHash, strconv.Itoa(msg.TimesSeen)}
+}
+
+func Join(msgSplit []string) []byte {
+	return []byte(strings.Join(msgSplit, " "))
+}
+
+func checkFields(msgSplit []string, topic string, num int) error {
+	if len(msgSplit) == 0 || msgSplit[0] != topic {
+		return fmt.Errorf("expected '%v' message", topic)
+	}
+	if len(msgSplit) != num {
+		return fmt.Errorf("%v: expected %v fields, found %v", topic, num, len(msgSplit))
+	}
+	return nil
+}
+
+// remembers the first error, so that fields can be parsed one after another without checking each
+type parser struct {
+	msgSplit []string
+	err      error
+}
+
+func (p *parser) fail(idx int, what string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%v: field %v: expected %v, found '%v'", p.msgSplit[0], idx, what, p.msgSplit[idx])
+	}
+}
+
+func (p *parser) trytes(idx int, length int) string {
+	s := p.msgSplit[idx]
+	if !IsTrytesOfLen(s, length) {
+		p.fail(idx, fmt.Sprintf("%v trytes", length))
+	}
+	return s
+}
+
+func (p *parser) int64(idx int) int64 {
+	ret, err := strconv.ParseInt(p.msgSplit[idx], 10, 64)
+	if err != nil {
+		p.fail(idx, "integer")
+	}
+	return ret
+}
+
+func (p *parser) uint64(idx int) uint64 {
+	ret, err := strconv.ParseUint(p.msgSplit[idx], 10, 64)
+	if err != nil {
+		p.fail(idx, "unsigned integer")
+	}
+	return ret
+}
+
+// non-negative int
+func (p *parser) index(idx int) int {
+	ret, err := strconv.ParseUint(p.msgSplit[idx], 10, 31)
+	if err != nil {
+		p.fail(idx, "index")
+	}
+	return int(ret)
+}
+
+func IsTrytesOfLen(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '9' && (s[i] < 'A' || s[i] > 'Z') {
+			return false
+		}
+	}
+	return true
+}
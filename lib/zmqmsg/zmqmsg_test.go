@@ -0,0 +1,115 @@
+package zmqmsg
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	hash4test = strings.Repeat("A", 80) + "9"
+	tag4test  = "TANGLEBEAT" + strings.Repeat("9", 17)
+)
+
+var txMsg4test = "tx " + hash4test + " " + hash4test + " -1000 " + tag4test + " 1546300800 1 3 " +
+	hash4test + " " + hash4test + " " + hash4test + " 1546300801 " + tag4test
+
+func Test_ParseTx(t *testing.T) {
+	tx, err := ParseTx(Split([]byte(txMsg4test)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tx.Value != -1000 || tx.CurrentIndex != 1 || tx.LastIndex != 3 || tx.Bundle != hash4test || tx.Tag != tag4test {
+		t.Errorf("Wrong fields: %+v", tx)
+	}
+	if string(Join(tx.Split())) != txMsg4test {
+		t.Errorf("Split must restore the message")
+	}
+}
+
+func Test_ParseInvalid(t *testing.T) {
+	invalid := []string{
+		"tx",
+		"tx " + hash4test,
+		strings.Replace(txMsg4test, " -1000 ", " 1k ", 1),
+		strings.Replace(txMsg4test, " 1 3 ", " 4 3 ", 1),
+		strings.Replace(txMsg4test, " 1 3 ", " -1 3 ", 1),
+		strings.Replace(txMsg4test, "tx "+hash4test, "tx "+strings.ToLower(hash4test), 1),
+		txMsg4test + " extra",
+		"sn 1000 " + hash4test,
+		"lmi 10",
+		"lmi 10 x",
+		"lmhs " + hash4test[:80],
+		"seen " + hash4test + " -2",
+	}
+	for _, s := range invalid {
+		if _, err := Parse(Split([]byte(s))); err == nil {
+			t.Errorf("Must return an error for '%v'", s)
+		}
+	}
+}
+
+func Test_ParseTopics(t *testing.T) {
+	sn := "sn 1000 " + hash4test + " " + hash4test + " " + hash4test + " " + hash4test + " " + hash4test
+	msg, err := Parse(Split([]byte(sn)))
+	if snMsg, ok := msg.(*SnMsg); err != nil || !ok || snMsg.Index != 1000 || snMsg.Bundle != hash4test {
+		t.Errorf("Wrong sn message: %+v, %v", msg, err)
+	}
+	msg, err = Parse(Split([]byte("lmi 10 11")))
+	if lmi, ok := msg.(*LmiMsg); err != nil || !ok || lmi.PrevIndex != 10 || lmi.Index != 11 {
+		t.Errorf("Wrong lmi message: %+v, %v", msg, err)
+	}
+	msg, err = Parse(Split([]byte("lmhs " + hash4test)))
+	if lmhs, ok := msg.(*LmhsMsg); err != nil || !ok || lmhs.Hash != hash4test {
+		t.Errorf("Wrong lmhs message: %+v, %v", msg, err)
+	}
+	msg, err = Parse(Split([]byte("seen " + hash4test + " 2")))
+	if seen, ok := msg.(*SeenMsg); err != nil || !ok || seen.TimesSeen != 2 {
+		t.Errorf("Wrong seen message: %+v, %v", msg, err)
+	}
+	msg, err = Parse(Split([]byte("lmsi 10 11")))
+	if msg != nil || err != nil {
+		t.Errorf("Other topics must not be parsed")
+	}
+}
+
+// parser must never panic. Messages which are parsed must be restored by Split
+func FuzzParse(f *testing.F) {
+	f.Add(txMsg4test)
+	f.Add("sn 1000 " + hash4test + " " + hash4test + " " + hash4test + " " + hash4test + " " + hash4test)
+	f.Add("lmi 10 11")
+	f.Add("lmhs " + hash4test)
+	f.Add("seen " + hash4test + " 2")
+	f.Add("tx  ")
+	f.Fuzz(func(t *testing.T, s string) {
+		msg, err := Parse(Split([]byte(s)))
+		if err != nil {
+			return
+		}
+		var restored []string
+		switch m := msg.(type) {
+		case *TxMsg:
+			restored = m.Split()
+		case *SeenMsg:
+			restored = m.Split()
+		default:
+			return
+		}
+		m2, err := Parse(restored)
+		if err != nil {
+			t.Fatalf("Restored message '%v' is invalid: %v", string(Join(restored)), err)
+		}
+		if string(Join(restored)) != string(Join(splitOf(m2))) {
+			t.Errorf("Restored message differs")
+		}
+	})
+}
+
+func splitOf(msg interface{}) []string {
+	switch m := msg.(type) {
+	case *TxMsg:
+		return m.Split()
+	case *SeenMsg:
+		return m.Split()
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/op/go-logging"
 	"github.com/unioproject/tanglebeat/lib/config"
 	"os"
+	"sync"
 )
 
 const (
@@ -23,30 +24,209 @@ func GetLog() *logging.Logger {
 }
 
 type inputsOutput struct {
-	OutputEnabled bool     `yaml:"outputEnabled"`
-	OutputPort    int      `yaml:"outputPort"`
-	InputsZMQ     []string `yaml:"inputsZMQ"`
-	InputsNanomsg []string `yaml:"inputsNanomsg"`
+	OutputEnabled bool               `yaml:"outputEnabled"`
+	OutputPort    int                `yaml:"outputPort"`
+	Outputs       []OutputSinkParams `yaml:"outputs"`
+	InputsZMQ     []string           `yaml:"inputsZMQ"`
+	InputsNanomsg []string           `yaml:"inputsNanomsg"`
 }
 
+// output transport of the stream. ZMQ and Nanomsg sinks listen on 'port', WebSocket and SSE sinks
+// are served on 'path' of the web server. Only messages of 'topics' are sent (all topics if empty).
+// Messages are dropped when the buffer of the sink (of each client for web sinks) is full
+type OutputSinkParams struct {
+	Type       string   `yaml:"type"`
+	Port       int      `yaml:"port"`
+	Path       string   `yaml:"path"`
+	Topics     []string `yaml:"topics"`
+	BufferSize int      `yaml:"bufferSize"`
+}
+
+const (
+	SinkZMQ       = "zmq"
+	SinkNanomsg   = "nanomsg"
+	SinkWebSocket = "websocket"
+	SinkSSE       = "sse"
+)
+
+// outputEnabled and outputPort is the Nanomsg sink with all topics, same as before 'outputs'
+func (io *inputsOutput) OutputSinks() []OutputSinkParams {
+	var ret []OutputSinkParams
+	if io.OutputEnabled {
+		ret = append(ret, OutputSinkParams{Type: SinkNanomsg, Port: io.OutputPort, BufferSize: defaultSinkBufferSize})
+	}
+	return append(ret, io.Outputs...)
+}
+
+const defaultSinkBufferSize = 1000
+
+// WebSocket feed at '/ws' of the web server. Clients which are behind more than 'bufferSize' messages
+// are disconnected. Stats of the hub are sent to subscribers every 'statsEverySec' seconds
+type wsFeedParams struct {
+	BufferSize    int `yaml:"bufferSize"`
+	StatsEverySec int `yaml:"statsEverySec"`
+}
+
+// histograms of durations with buckets in seconds by histogram name. Buckets which are not configured
+// or are not ascending are taken by default. Averaged gauges and duration counters which were used before
+// histograms are exposed unless 'legacyGaugesDisabled' is true
+type histogramsParams struct {
+	LegacyGaugesDisabled bool                 `yaml:"legacyGaugesDisabled"`
+	Buckets              map[string][]float64 `yaml:"buckets"`
+}
+
+const (
+	HistogramConfirmation            = "confirmation"
+	HistogramPoW                     = "pow"
+	HistogramTipsel                  = "tipsel"
+	HistogramEcho                    = "echo"
+	HistogramQuorum                  = "quorum"
+	HistogramValueBundleConfirmation = "valueBundleConfirmation"
+)
+
+var defaultHistogramBuckets = map[string][]float64{
+	HistogramConfirmation:            {30, 60, 120, 180, 300, 450, 600, 900, 1200, 1800, 3600},
+	HistogramPoW:                     {0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	HistogramTipsel:                  {0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	HistogramEcho:                    {0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+	HistogramQuorum:                  {0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+	HistogramValueBundleConfirmation: {15, 30, 60, 120, 240, 480, 960, 1920, 3840, 7680},
+}
+
+func strictlyAscending(buckets []float64) bool {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// with weighted quorum message passes when sum of weights of inputs it was received from
+// reaches the threshold. Weights are taken from the config (default is 1) and, if 'auto' is true,
+// lowered for inputs which are slow, inactive, not propagating or not confirming messages
+type weightedQuorumParams struct {
+	Enabled     bool               `yaml:"enabled"`
+	TxThreshold float64            `yaml:"txThreshold"`
+	SnThreshold float64            `yaml:"snThreshold"`
+	Auto        bool               `yaml:"auto"`
+	Weights     map[string]float64 `yaml:"weights"`
+}
+
+// rule of the input health policy. Meaning of the threshold depends on the rule:
+//
+//	tpsWithoutCtps: input has ctps == 0 and tps bigger than threshold times average tps of inputs
+//	staleHeartbeat: no messages from the input for threshold seconds
+//	noSn:           no sn messages from the input for threshold minutes
+//	seenOnceRate:   seen once rate of the input is above threshold percent
+//	lmiLag:         last milestone index of the input is threshold or more milestones behind
+//
+// Action is one of 'closeValve', 'hold' (for holdMin minutes) or 'drop'
+type InputHealthRule struct {
+	Rule      string  `yaml:"rule"`
+	Action    string  `yaml:"action"`
+	Threshold float64 `yaml:"threshold"`
+	HoldMin   int     `yaml:"holdMin"`
+}
+
+type inputHealthPolicyParams struct {
+	CheckEverySec    int               `yaml:"checkEverySec"`
+	StartAfterSec    int               `yaml:"startAfterSec"`    // inputs running less are not checked
+	MinRunningInputs int               `yaml:"minRunningInputs"` // inputs are not put on hold or dropped below that
+	Rules            []InputHealthRule `yaml:"rules"`
+}
+
+// failed input is restarted after delay which doubles with each failure from baseSec up to maxSec.
+// Delays are randomized by +-jitter fraction. Counter of failures is reset after resetAfterSec of reading
+type inputRestartParams struct {
+	BaseSec       int     `yaml:"baseSec"`
+	MaxSec        int     `yaml:"maxSec"`
+	ResetAfterSec int     `yaml:"resetAfterSec"`
+	Jitter        float64 `yaml:"jitter"`
+}
+
+// hash caches are saved to files in the directory on shutdown and every 'everyMin' minutes
+// and restored at startup. Expired segments are not restored
+type cacheSnapshotParams struct {
+	Enabled  bool   `yaml:"enabled"`
+	Dir      string `yaml:"dir"`
+	EveryMin int    `yaml:"everyMin"`
+}
+
+// additional topic passed to the output by the generic quorum filter. Messages are identified by
+// the field with index keyField (topic is the field 0, default is 1). Message passes when seen from 'quorum'
+// inputs (quorumToPass by default) or, with weighted quorum, when sum of weights of inputs reaches 'quorum'.
+// If timeIntervalMsec is not 0, quorum must be reached within that time
+type TopicFilter struct {
+	Topic            string `yaml:"topic"`
+	KeyField         int    `yaml:"keyField"`
+	Quorum           int    `yaml:"quorum"`
+	TimeIntervalMsec uint64 `yaml:"timeIntervalMsec"`
+}
+
+// queue of messages from inputs to the filter. When it is full, policy decides:
+//
+//	block:      input routine waits until there is place in the queue (default)
+//	dropOldest: the oldest message in the queue is dropped
+//	dropNewest: the new message is dropped
+type filterQueueParams struct {
+	Size   int    `yaml:"size"`
+	Policy string `yaml:"policy"`
+}
+
+const (
+	FilterQueueBlock      = "block"
+	FilterQueueDropOldest = "dropOldest"
+	FilterQueueDropNewest = "dropNewest"
+)
+
 type ConfigStructYAML struct {
-	Debug                               bool         `yaml:"debug"`
-	WebServerPort                       int          `yaml:"webServerPort"`
-	IriMsgStream                        inputsOutput `yaml:"iriMsgStream"`
-	SenderMsgStream                     inputsOutput `yaml:"senderMsgStream"`
-	RetentionPeriodMin                  int          `yaml:"retentionPeriodMin"`
-	QuorumTxToPass                      int          `yaml:"quorumToPass"`
-	QuorumMilestoneHashToPass           int          `yaml:"quorumMilestoneHashToPass"`
-	TimeIntervalMilestoneHashToPassMsec uint64       `yaml:"timeIntervalMilestoneHashToPassMsec"`
-	MultiQuorumMetricsEnabled           bool         `yaml:"multiQuorumMetricsEnabled"`
-	QuorumUpdatesEnabled                bool         `yaml:"quorumUpdatesEnabled"`
-	QuorumUpdatesFrom                   int          `yaml:"quorumUpdatesFrom"`
-	QuorumUpdatesTo                     int          `yaml:"quorumUpdatesTo"`
-	SpawnCmd                            []string     `yaml:"spawnCmd"`
+	Debug                               bool                    `yaml:"debug"`
+	WebServerPort                       int                     `yaml:"webServerPort"`
+	InputsAPIEnabled                    bool                    `yaml:"inputsApiEnabled"`
+	IriMsgStream                        inputsOutput            `yaml:"iriMsgStream"`
+	SenderMsgStream                     inputsOutput            `yaml:"senderMsgStream"`
+	RetentionPeriodMin                  int                     `yaml:"retentionPeriodMin"`
+	QuorumTxToPass                      int                     `yaml:"quorumToPass"`
+	QuorumSnToPass                      int                     `yaml:"quorumSnToPass"`
+	QuorumLmiToPass                     int                     `yaml:"quorumLmiToPass"`
+	QuorumMilestoneHashToPass           int                     `yaml:"quorumMilestoneHashToPass"`
+	TimeIntervalMilestoneHashToPassMsec uint64                  `yaml:"timeIntervalMilestoneHashToPassMsec"`
+	TimeIntervalTxToPassMsec            uint64                  `yaml:"timeIntervalTxToPassMsec"`
+	TimeIntervalSnToPassMsec            uint64                  `yaml:"timeIntervalSnToPassMsec"`
+	WeightedQuorum                      weightedQuorumParams    `yaml:"weightedQuorum"`
+	InputHealthPolicy                   inputHealthPolicyParams `yaml:"inputHealthPolicy"`
+	InputRestart                        inputRestartParams      `yaml:"inputRestart"`
+	CacheSnapshot                       cacheSnapshotParams     `yaml:"cacheSnapshot"`
+	FilterWorkers                       int                     `yaml:"filterWorkers"`
+	FilterQueue                         filterQueueParams       `yaml:"filterQueue"`
+	ExtraTopics                         []TopicFilter           `yaml:"extraTopics"`
+	InputTopics                         map[string][]string     `yaml:"inputTopics"`    // topics of the input by uri
+	TxTrytesInputs                      []string                `yaml:"txTrytesInputs"` // uris of inputs read in tx_trytes mode
+	WsFeed                              wsFeedParams            `yaml:"wsFeed"`
+	Histograms                          histogramsParams        `yaml:"histograms"`
+	MultiQuorumMetricsEnabled           bool                    `yaml:"multiQuorumMetricsEnabled"`
+	QuorumUpdatesEnabled                bool                    `yaml:"quorumUpdatesEnabled"`
+	QuorumUpdatesFrom                   int                     `yaml:"quorumUpdatesFrom"`
+	QuorumUpdatesTo                     int                     `yaml:"quorumUpdatesTo"`
+	SpawnCmd                            []string                `yaml:"spawnCmd"`
+	ShutdownTimeoutSec                  int                     `yaml:"shutdownTimeoutSec"`
 }
 
 var Config = ConfigStructYAML{}
 
+// parameters which can be changed while running (by reloading config file)
+// must be read and written under configMutex
+var configMutex = &sync.RWMutex{}
+
+func RLock() {
+	configMutex.RLock()
+}
+
+func RUnlock() {
+	configMutex.RUnlock()
+}
+
 func initLogging(msgBeforeLog []string) ([]string, bool) {
 	log = logging.MustGetLogger("tanglebeat")
 	backend := logging.NewLogBackend(os.Stderr, "", 0)
@@ -86,36 +266,216 @@ func MustReadConfig(cfgfile string) {
 	}
 
 	infof("Debug = %v", Config.Debug)
-	// default values
-	if Config.QuorumTxToPass == 0 {
-		Config.QuorumTxToPass = 2
-	}
-	if Config.RetentionPeriodMin == 0 {
-		Config.RetentionPeriodMin = 60
-	}
+	infof("Changing inputs through API enabled = %v", Config.InputsAPIEnabled)
+	setDefaults(&Config)
+	startupConfig = Config
+
 	infof("Quorum to pass a message: TX message will be accepted after received %v times from different sources",
 		Config.QuorumTxToPass)
-
-	if Config.QuorumMilestoneHashToPass == 0 {
-		Config.QuorumMilestoneHashToPass = 3
+	infof("Quorum to pass a message: SN message = %v, LMI message = %v",
+		Config.QuorumSnToPass, Config.QuorumLmiToPass)
+	infof("Time interval to reach quorum (0 = unlimited): TX message = %v msec, SN message = %v msec",
+		Config.TimeIntervalTxToPassMsec, Config.TimeIntervalSnToPassMsec)
+	infof("Weighted quorum enabled = %v", Config.WeightedQuorum.Enabled)
+	if Config.WeightedQuorum.Enabled {
+		infof("Weighted quorum: TX threshold = %v, SN threshold = %v, auto weights = %v, configured weights: %v",
+			Config.WeightedQuorum.TxThreshold, Config.WeightedQuorum.SnThreshold,
+			Config.WeightedQuorum.Auto, Config.WeightedQuorum.Weights)
+	}
+	infof("Input health policy: check every %v sec, start after %v sec, min running inputs %v, rules: %+v",
+		Config.InputHealthPolicy.CheckEverySec, Config.InputHealthPolicy.StartAfterSec,
+		Config.InputHealthPolicy.MinRunningInputs, Config.InputHealthPolicy.Rules)
+	infof("Input restart: delay from %v sec up to %v sec, reset after %v sec, jitter %v",
+		Config.InputRestart.BaseSec, Config.InputRestart.MaxSec, Config.InputRestart.ResetAfterSec, Config.InputRestart.Jitter)
+	infof("Number of filter workers for tx messages = %v", Config.FilterWorkers)
+	infof("Filter queue: size %v, policy '%v'", Config.FilterQueue.Size, Config.FilterQueue.Policy)
+	if len(Config.ExtraTopics) > 0 {
+		infof("Extra topics: %+v", Config.ExtraTopics)
+	}
+	if len(Config.InputTopics) > 0 {
+		infof("Topics of inputs: %v", Config.InputTopics)
+	}
+	if len(Config.IriMsgStream.Outputs) > 0 {
+		infof("Outputs of the compound stream: %+v", Config.IriMsgStream.Outputs)
+	}
+	if len(Config.TxTrytesInputs) > 0 {
+		infof("Inputs in tx_trytes mode: %v", Config.TxTrytesInputs)
 	}
-	if Config.TimeIntervalMilestoneHashToPassMsec == 0 {
-		Config.TimeIntervalMilestoneHashToPassMsec = 5000
+	infof("WebSocket feed: client buffer %v messages, stats every %v sec",
+		Config.WsFeed.BufferSize, Config.WsFeed.StatsEverySec)
+	infof("Histogram buckets: %v", Config.Histograms.Buckets)
+	infof("Legacy gauges disabled = %v", Config.Histograms.LegacyGaugesDisabled)
+	infof("Cache snapshots enabled = %v", Config.CacheSnapshot.Enabled)
+	if Config.CacheSnapshot.Enabled {
+		infof("Cache snapshots: directory '%v', saved every %v min",
+			Config.CacheSnapshot.Dir, Config.CacheSnapshot.EveryMin)
 	}
 	infof("MultiQuorum metrics enabled = %v", Config.MultiQuorumMetricsEnabled)
 	infof("QuorumUpdatesEnabled = %v", Config.QuorumUpdatesEnabled)
 	if Config.QuorumUpdatesEnabled {
-		if Config.QuorumUpdatesFrom == 0 {
-			Config.QuorumUpdatesFrom = 1
-		}
-		if Config.QuorumUpdatesTo == 0 {
-			Config.QuorumUpdatesTo = 5
-		}
 		infof("QuorumUpdatesFrom = %d, QuorumUpdatesTo = %d",
 			Config.QuorumUpdatesFrom, Config.QuorumUpdatesTo)
 	}
 }
 
+func setDefaults(c *ConfigStructYAML) {
+	if c.QuorumTxToPass == 0 {
+		c.QuorumTxToPass = 2
+	}
+	if c.QuorumSnToPass == 0 {
+		c.QuorumSnToPass = 3
+	}
+	if c.QuorumLmiToPass == 0 {
+		// lmi used to pass on the 4th sighting when the quorum was not configurable
+		c.QuorumLmiToPass = 4
+	}
+	if c.RetentionPeriodMin == 0 {
+		c.RetentionPeriodMin = 60
+	}
+	if c.WeightedQuorum.TxThreshold == 0 {
+		c.WeightedQuorum.TxThreshold = float64(c.QuorumTxToPass)
+	}
+	if c.WeightedQuorum.SnThreshold == 0 {
+		c.WeightedQuorum.SnThreshold = float64(c.QuorumSnToPass)
+	}
+	if c.InputHealthPolicy.CheckEverySec == 0 {
+		c.InputHealthPolicy.CheckEverySec = 120
+	}
+	if c.InputHealthPolicy.StartAfterSec == 0 {
+		c.InputHealthPolicy.StartAfterSec = 180
+	}
+	if c.InputHealthPolicy.MinRunningInputs == 0 {
+		c.InputHealthPolicy.MinRunningInputs = 10
+	}
+	if len(c.InputHealthPolicy.Rules) == 0 {
+		// the output valve: inputs which do not confirm but produce a lot of transactions
+		c.InputHealthPolicy.Rules = []InputHealthRule{{Rule: "tpsWithoutCtps", Action: "closeValve", Threshold: 2}}
+	}
+	for i := range c.InputHealthPolicy.Rules {
+		if c.InputHealthPolicy.Rules[i].Action == "hold" && c.InputHealthPolicy.Rules[i].HoldMin == 0 {
+			c.InputHealthPolicy.Rules[i].HoldMin = 15
+		}
+	}
+	if c.InputRestart.BaseSec <= 0 {
+		c.InputRestart.BaseSec = 15
+	}
+	if c.InputRestart.MaxSec <= 0 {
+		c.InputRestart.MaxSec = 600
+	}
+	if c.InputRestart.MaxSec < c.InputRestart.BaseSec {
+		c.InputRestart.MaxSec = c.InputRestart.BaseSec
+	}
+	if c.InputRestart.ResetAfterSec <= 0 {
+		c.InputRestart.ResetAfterSec = 300
+	}
+	if c.InputRestart.Jitter == 0 {
+		c.InputRestart.Jitter = 0.2
+	}
+	if c.InputRestart.Jitter < 0 || c.InputRestart.Jitter >= 1 {
+		if logInitialized {
+			log.Errorf("Wrong inputRestart.jitter %v, using 0.2", c.InputRestart.Jitter)
+		}
+		c.InputRestart.Jitter = 0.2
+	}
+	if c.CacheSnapshot.Dir == "" {
+		c.CacheSnapshot.Dir = "snapshot"
+	}
+	if c.CacheSnapshot.EveryMin <= 0 {
+		if c.CacheSnapshot.EveryMin < 0 && logInitialized {
+			log.Errorf("Wrong cacheSnapshot.everyMin %v, using 10", c.CacheSnapshot.EveryMin)
+		}
+		c.CacheSnapshot.EveryMin = 10
+	}
+	if c.FilterQueue.Size == 0 {
+		c.FilterQueue.Size = 100
+	}
+	switch c.FilterQueue.Policy {
+	case FilterQueueBlock, FilterQueueDropOldest, FilterQueueDropNewest:
+	default:
+		if c.FilterQueue.Policy != "" && logInitialized {
+			log.Errorf("Unknown filter queue policy '%v', using '%v'", c.FilterQueue.Policy, FilterQueueBlock)
+		}
+		c.FilterQueue.Policy = FilterQueueBlock
+	}
+	if c.WsFeed.BufferSize == 0 {
+		c.WsFeed.BufferSize = 256
+	}
+	if c.WsFeed.StatsEverySec == 0 {
+		c.WsFeed.StatsEverySec = 5
+	}
+	if c.Histograms.Buckets == nil {
+		c.Histograms.Buckets = make(map[string][]float64)
+	}
+	for name, buckets := range c.Histograms.Buckets {
+		if _, ok := defaultHistogramBuckets[name]; !ok && logInitialized {
+			log.Errorf("Unknown histogram '%v' in histograms.buckets", name)
+		}
+		if !strictlyAscending(buckets) {
+			if logInitialized {
+				log.Errorf("Buckets of histogram '%v' are not ascending, using default", name)
+			}
+			delete(c.Histograms.Buckets, name)
+		}
+	}
+	for name, buckets := range defaultHistogramBuckets {
+		if len(c.Histograms.Buckets[name]) == 0 {
+			c.Histograms.Buckets[name] = buckets
+		}
+	}
+	for i := range c.IriMsgStream.Outputs {
+		o := &c.IriMsgStream.Outputs[i]
+		if o.BufferSize == 0 {
+			o.BufferSize = defaultSinkBufferSize
+		}
+		if o.Path == "" {
+			switch o.Type {
+			case SinkWebSocket:
+				o.Path = "/stream/ws"
+			case SinkSSE:
+				o.Path = "/stream/sse"
+			}
+		}
+	}
+	// field 0 is the topic itself, so the key can't be there
+	topics := c.ExtraTopics[:0]
+	for _, tf := range c.ExtraTopics {
+		if tf.KeyField == 0 {
+			tf.KeyField = 1
+		}
+		if tf.KeyField < 1 {
+			if logInitialized {
+				log.Errorf("Wrong keyField %v of extra topic '%v'. Topic ignored", tf.KeyField, tf.Topic)
+			}
+			continue
+		}
+		if tf.Quorum == 0 {
+			tf.Quorum = c.QuorumTxToPass
+		}
+		topics = append(topics, tf)
+	}
+	c.ExtraTopics = topics
+	if c.FilterWorkers == 0 {
+		c.FilterWorkers = 1
+	}
+	if c.ShutdownTimeoutSec == 0 {
+		c.ShutdownTimeoutSec = 10
+	}
+	if c.QuorumMilestoneHashToPass == 0 {
+		c.QuorumMilestoneHashToPass = 3
+	}
+	if c.TimeIntervalMilestoneHashToPassMsec == 0 {
+		c.TimeIntervalMilestoneHashToPassMsec = 5000
+	}
+	if c.QuorumUpdatesEnabled {
+		if c.QuorumUpdatesFrom == 0 {
+			c.QuorumUpdatesFrom = 1
+		}
+		if c.QuorumUpdatesTo == 0 {
+			c.QuorumUpdatesTo = 5
+		}
+	}
+}
+
 func infof(format string, args ...interface{}) {
 	log.Infof(format, args...)
 }
@@ -0,0 +1,184 @@
+package cfg
+
+import (
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/config"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"reflect"
+	"strings"
+)
+
+// Config file can be re-read while running (on SIGHUP).
+// Parameters which can be changed live are applied immediately.
+// Inputs and spawned commands are compared with those actually running and
+// are written back to the config only after changes are applied.
+// The rest are only reported as requiring restart
+
+type ConfigChanges struct {
+	InputsZMQAdded       []string
+	InputsZMQRemoved     []string
+	InputsNanomsgAdded   []string
+	InputsNanomsgRemoved []string
+	SpawnCmdAdded        []string
+	SpawnCmdRemoved      []string
+	Applied              []string // descriptions of changed live parameters
+	RestartRequired      []string // names of changed parameters which can't be applied live
+}
+
+// inputs and commands which are actually running
+type RunningLists struct {
+	InputsZMQ     []string
+	InputsNanomsg []string
+	SpawnCmd      []string
+}
+
+var (
+	startupConfig   ConfigStructYAML // values the instance was started with
+	restartRequired = make([]string, 0)
+)
+
+// list of parameters which were changed in the config file but will only be effective after restart
+func GetRestartRequired() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	ret := make([]string, len(restartRequired))
+	copy(ret, restartRequired)
+	return ret
+}
+
+func ReloadConfig(cfgfile string, running *RunningLists) (*ConfigChanges, error) {
+	var newConfig ConfigStructYAML
+	msgs, _, success := config.ReadYAML(cfgfile, nil, &newConfig)
+	if !success {
+		return nil, fmt.Errorf("failed to reload config file '%v': %v", cfgfile, strings.Join(msgs, "; "))
+	}
+	setDefaults(&newConfig)
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	ret := &ConfigChanges{
+		Applied:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+	ret.InputsZMQAdded, ret.InputsZMQRemoved = diffStrings(running.InputsZMQ, newConfig.IriMsgStream.InputsZMQ)
+	ret.InputsNanomsgAdded, ret.InputsNanomsgRemoved = diffStrings(running.InputsNanomsg, newConfig.IriMsgStream.InputsNanomsg)
+	ret.SpawnCmdAdded, ret.SpawnCmdRemoved = diffStrings(running.SpawnCmd, newConfig.SpawnCmd)
+
+	applied := func(name string, oldValue, newValue interface{}) {
+		if oldValue != newValue {
+			ret.Applied = append(ret.Applied, fmt.Sprintf("%v: %v -> %v", name, oldValue, newValue))
+		}
+	}
+	applied("quorumToPass", Config.QuorumTxToPass, newConfig.QuorumTxToPass)
+	Config.QuorumTxToPass = newConfig.QuorumTxToPass
+
+	applied("quorumSnToPass", Config.QuorumSnToPass, newConfig.QuorumSnToPass)
+	Config.QuorumSnToPass = newConfig.QuorumSnToPass
+
+	applied("quorumLmiToPass", Config.QuorumLmiToPass, newConfig.QuorumLmiToPass)
+	Config.QuorumLmiToPass = newConfig.QuorumLmiToPass
+
+	applied("quorumMilestoneHashToPass", Config.QuorumMilestoneHashToPass, newConfig.QuorumMilestoneHashToPass)
+	Config.QuorumMilestoneHashToPass = newConfig.QuorumMilestoneHashToPass
+
+	applied("timeIntervalMilestoneHashToPassMsec",
+		Config.TimeIntervalMilestoneHashToPassMsec, newConfig.TimeIntervalMilestoneHashToPassMsec)
+	Config.TimeIntervalMilestoneHashToPassMsec = newConfig.TimeIntervalMilestoneHashToPassMsec
+
+	applied("timeIntervalTxToPassMsec", Config.TimeIntervalTxToPassMsec, newConfig.TimeIntervalTxToPassMsec)
+	Config.TimeIntervalTxToPassMsec = newConfig.TimeIntervalTxToPassMsec
+
+	applied("timeIntervalSnToPassMsec", Config.TimeIntervalSnToPassMsec, newConfig.TimeIntervalSnToPassMsec)
+	Config.TimeIntervalSnToPassMsec = newConfig.TimeIntervalSnToPassMsec
+
+	if !reflect.DeepEqual(Config.WeightedQuorum, newConfig.WeightedQuorum) {
+		ret.Applied = append(ret.Applied, fmt.Sprintf("weightedQuorum: %+v -> %+v",
+			Config.WeightedQuorum, newConfig.WeightedQuorum))
+	}
+	Config.WeightedQuorum = newConfig.WeightedQuorum
+
+	if !reflect.DeepEqual(Config.InputHealthPolicy, newConfig.InputHealthPolicy) {
+		ret.Applied = append(ret.Applied, fmt.Sprintf("inputHealthPolicy: %+v -> %+v",
+			Config.InputHealthPolicy, newConfig.InputHealthPolicy))
+	}
+	Config.InputHealthPolicy = newConfig.InputHealthPolicy
+
+	applied("filterQueue.policy", Config.FilterQueue.Policy, newConfig.FilterQueue.Policy)
+	Config.FilterQueue.Policy = newConfig.FilterQueue.Policy
+
+	applied("shutdownTimeoutSec", Config.ShutdownTimeoutSec, newConfig.ShutdownTimeoutSec)
+	Config.ShutdownTimeoutSec = newConfig.ShutdownTimeoutSec
+
+	applied("quorumUpdatesEnabled", Config.QuorumUpdatesEnabled, newConfig.QuorumUpdatesEnabled)
+	Config.QuorumUpdatesEnabled = newConfig.QuorumUpdatesEnabled
+
+	applied("quorumUpdatesFrom", Config.QuorumUpdatesFrom, newConfig.QuorumUpdatesFrom)
+	Config.QuorumUpdatesFrom = newConfig.QuorumUpdatesFrom
+
+	applied("quorumUpdatesTo", Config.QuorumUpdatesTo, newConfig.QuorumUpdatesTo)
+	Config.QuorumUpdatesTo = newConfig.QuorumUpdatesTo
+
+	// comparing with the values the instance was started with
+	changed := func(name string, isChanged bool) {
+		if isChanged {
+			ret.RestartRequired = append(ret.RestartRequired, name)
+		}
+	}
+	changed("debug", startupConfig.Debug != newConfig.Debug)
+	changed("webServerPort", startupConfig.WebServerPort != newConfig.WebServerPort)
+	changed("inputsApiEnabled", startupConfig.InputsAPIEnabled != newConfig.InputsAPIEnabled)
+	changed("iriMsgStream.outputEnabled",
+		startupConfig.IriMsgStream.OutputEnabled != newConfig.IriMsgStream.OutputEnabled)
+	changed("iriMsgStream.outputPort",
+		startupConfig.IriMsgStream.OutputPort != newConfig.IriMsgStream.OutputPort)
+	changed("iriMsgStream.outputs",
+		!reflect.DeepEqual(startupConfig.IriMsgStream.Outputs, newConfig.IriMsgStream.Outputs))
+	changed("senderMsgStream.outputEnabled",
+		startupConfig.SenderMsgStream.OutputEnabled != newConfig.SenderMsgStream.OutputEnabled)
+	changed("senderMsgStream.outputPort",
+		startupConfig.SenderMsgStream.OutputPort != newConfig.SenderMsgStream.OutputPort)
+	added, removed := diffStrings(startupConfig.SenderMsgStream.InputsNanomsg, newConfig.SenderMsgStream.InputsNanomsg)
+	changed("senderMsgStream.inputsNanomsg", len(added)+len(removed) > 0)
+	changed("retentionPeriodMin", startupConfig.RetentionPeriodMin != newConfig.RetentionPeriodMin)
+	changed("extraTopics", !reflect.DeepEqual(startupConfig.ExtraTopics, newConfig.ExtraTopics))
+	changed("inputTopics", !reflect.DeepEqual(startupConfig.InputTopics, newConfig.InputTopics))
+	changed("wsFeed", startupConfig.WsFeed != newConfig.WsFeed)
+	changed("histograms", !reflect.DeepEqual(startupConfig.Histograms, newConfig.Histograms))
+	changed("txTrytesInputs", !reflect.DeepEqual(startupConfig.TxTrytesInputs, newConfig.TxTrytesInputs))
+	changed("filterQueue.size", startupConfig.FilterQueue.Size != newConfig.FilterQueue.Size)
+	changed("filterWorkers", startupConfig.FilterWorkers != newConfig.FilterWorkers)
+	changed("cacheSnapshot", startupConfig.CacheSnapshot != newConfig.CacheSnapshot)
+	changed("inputRestart", startupConfig.InputRestart != newConfig.InputRestart)
+	changed("multiQuorumMetricsEnabled",
+		startupConfig.MultiQuorumMetricsEnabled != newConfig.MultiQuorumMetricsEnabled)
+
+	restartRequired = ret.RestartRequired
+	return ret, nil
+}
+
+// to be called after changes of inputs and commands are applied, so that the config shows what is running
+func SetRunningLists(running *RunningLists) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	Config.IriMsgStream.InputsZMQ = running.InputsZMQ
+	Config.IriMsgStream.InputsNanomsg = running.InputsNanomsg
+	Config.SpawnCmd = running.SpawnCmd
+}
+
+// returns elements of newList which are not in oldList and elements of oldList which are not in newList
+func diffStrings(oldList, newList []string) ([]string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	for _, s := range newList {
+		if !utils.StringInSlice(s, oldList) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range oldList {
+		if !utils.StringInSlice(s, newList) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,118 @@
+package cfg
+
+import (
+	"github.com/unioproject/tanglebeat/lib/config"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_DiffStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldList []string
+		newList []string
+		added   []string
+		removed []string
+	}{
+		{"both empty", nil, nil, []string{}, []string{}},
+		{"same", []string{"a", "b"}, []string{"b", "a"}, []string{}, []string{}},
+		{"added", []string{"a"}, []string{"a", "b", "c"}, []string{"b", "c"}, []string{}},
+		{"removed", []string{"a", "b", "c"}, []string{"b"}, []string{}, []string{"a", "c"}},
+		{"replaced", []string{"a", "b"}, []string{"b", "c"}, []string{"c"}, []string{"a"}},
+		{"from empty", nil, []string{"a"}, []string{"a"}, []string{}},
+		{"to empty", []string{"a"}, nil, []string{}, []string{"a"}},
+	}
+	for _, test := range tests {
+		added, removed := diffStrings(test.oldList, test.newList)
+		if !reflect.DeepEqual(added, test.added) || !reflect.DeepEqual(removed, test.removed) {
+			t.Errorf("%v: expected added %v, removed %v, got %v, %v",
+				test.name, test.added, test.removed, added, removed)
+		}
+	}
+}
+
+func readTestConfig(t *testing.T, fname string, yml string) ConfigStructYAML {
+	if err := ioutil.WriteFile(fname, []byte(yml), 0644); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	var ret ConfigStructYAML
+	if msgs, _, success := config.ReadYAML(fname, nil, &ret); !success {
+		t.Fatalf("reading config file: %v", msgs)
+	}
+	setDefaults(&ret)
+	return ret
+}
+
+const testConfigYml = `
+webServerPort: 8082
+quorumToPass: 3
+weightedQuorum:
+  txThreshold: 3
+  snThreshold: 3
+iriMsgStream:
+  inputsZMQ:
+  - tcp://node1:5556
+  - tcp://node2:5556
+  inputsNanomsg:
+  - tcp://nano1:5550
+spawnCmd:
+- cmd1
+`
+
+// reloaded lists are compared with what is running, not with the previous config
+func Test_ReloadConfig(t *testing.T) {
+	savedConfig, savedStartup, savedRestart := Config, startupConfig, restartRequired
+	defer func() {
+		Config, startupConfig, restartRequired = savedConfig, savedStartup, savedRestart
+	}()
+	fname := filepath.Join(t.TempDir(), "tanglebeat.yml")
+	Config = readTestConfig(t, fname, testConfigYml)
+	startupConfig = Config
+
+	// node2 was removed and api1 was added through the inputs API, cmd1 failed to start
+	running := &RunningLists{
+		InputsZMQ:     []string{"tcp://node1:5556", "tcp://api1:5556"},
+		InputsNanomsg: []string{"tcp://nano1:5550"},
+	}
+	newYml := strings.NewReplacer(
+		"webServerPort: 8082", "webServerPort: 8083",
+		"quorumToPass: 3", "quorumToPass: 2",
+		"tcp://nano1:5550", "tcp://nano2:5550",
+	).Replace(testConfigYml)
+	readTestConfig(t, fname, newYml)
+
+	changes, err := ReloadConfig(fname, running)
+	if err != nil {
+		t.Fatalf("reloading config: %v", err)
+	}
+	lists := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"zmq added", changes.InputsZMQAdded, []string{"tcp://node2:5556"}},
+		{"zmq removed", changes.InputsZMQRemoved, []string{"tcp://api1:5556"}},
+		{"nanomsg added", changes.InputsNanomsgAdded, []string{"tcp://nano2:5550"}},
+		{"nanomsg removed", changes.InputsNanomsgRemoved, []string{"tcp://nano1:5550"}},
+		{"cmd added", changes.SpawnCmdAdded, []string{"cmd1"}},
+		{"cmd removed", changes.SpawnCmdRemoved, []string{}},
+		{"applied", changes.Applied, []string{"quorumToPass: 3 -> 2"}},
+		{"restart required", changes.RestartRequired, []string{"webServerPort"}},
+	}
+	for _, l := range lists {
+		if !reflect.DeepEqual(l.got, l.expected) {
+			t.Errorf("%v: expected %v, got %v", l.name, l.expected, l.got)
+		}
+	}
+	if Config.QuorumTxToPass != 2 || Config.WebServerPort != 8082 {
+		t.Errorf("live parameter must be applied, others not: quorumToPass %v, webServerPort %v",
+			Config.QuorumTxToPass, Config.WebServerPort)
+	}
+	// lists are written to the config only after changes are applied
+	if !reflect.DeepEqual(Config.IriMsgStream.InputsNanomsg, []string{"tcp://nano1:5550"}) {
+		t.Errorf("inputs must not be changed by reload, got %v", Config.IriMsgStream.InputsNanomsg)
+	}
+}
@@ -3,19 +3,119 @@ package hashcache
 import (
 	"github.com/unioproject/tanglebeat/lib/ebuffer"
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"math"
+	"math/bits"
 )
 
+// set of ids of sources (inputs) which has seen the hash. Ids are bytes, so 256 bits
+type SourceSet [4]uint64
+
+// adds id to the set. Returns false if it was already there
+func (ss *SourceSet) Add(id byte) bool {
+	if ss.Contains(id) {
+		return false
+	}
+	ss[id>>6] |= 1 << (id & 63)
+	return true
+}
+
+func (ss *SourceSet) Contains(id byte) bool {
+	return ss[id>>6]&(1<<(id&63)) != 0
+}
+
+func (ss *SourceSet) Count() int {
+	return bits.OnesCount64(ss[0]) + bits.OnesCount64(ss[1]) + bits.OnesCount64(ss[2]) + bits.OnesCount64(ss[3])
+}
+
+// calls callback for each id in the set in ascending order
+func (ss *SourceSet) ForEach(callback func(id byte)) {
+	for i, w := range ss {
+		for w != 0 {
+			b := bits.TrailingZeros64(w)
+			callback(byte(i<<6 + b))
+			w &= w - 1
+		}
+	}
+}
+
+func (ss *SourceSet) Ids() []byte {
+	ret := make([]byte, 0, ss.Count())
+	ss.ForEach(func(id byte) {
+		ret = append(ret, id)
+	})
+	return ret
+}
+
+// when the visit is with source, Visits and Weight count distinct sources only.
+// Visits without source (e.g. echo buffer) are counted each time
 type CacheEntry struct {
 	FirstSeen    uint64
 	LastSeen     uint64
 	Visits       byte
 	FirstVisitId byte
+	Weight       float32   // sum of weights of visits. Equal to Visits if weights are not used
+	WeightBefore float32   // stored weight before the last visit. Equal to Weight if the last visit added nothing
+	Sources      SourceSet // ids of sources which has seen the hash
+	Repeated     bool      // last visit was from the source which has already seen the hash
 	Data         interface{}
 }
 
+const noSource = -1
+
+// HashKey is the binary key of the hash in the cache.
+// Prefixes of up to 13 trytes are packed into the key exactly: each tryte is a digit 1..27 of the base 28
+// number, so prefixes of different length never collide and 28^13 < 2^63.
+// Longer prefixes and strings which are not trytes are hashed with FNV-1a and have the highest bit set
+type HashKey uint64
+
+const (
+	maxPackedTrytes = 13
+	hashedKeyFlag   = HashKey(1) << 63
+	fnvOffset64     = 14695981039346656037
+	fnvPrime64      = 1099511628211
+)
+
+func packTrytes(s string) (HashKey, bool) {
+	var ret HashKey
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '9':
+			ret = ret*28 + 1
+		case 'A' <= c && c <= 'Z':
+			ret = ret*28 + HashKey(c-'A'+2)
+		default:
+			return 0, false
+		}
+	}
+	return ret, true
+}
+
+func hashFNV(s string) HashKey {
+	var ret uint64 = fnvOffset64
+	for i := 0; i < len(s); i++ {
+		ret ^= uint64(s[i])
+		ret *= fnvPrime64
+	}
+	return HashKey(ret) | hashedKeyFlag
+}
+
+// entry as it is stored in the segment. Times are offsets in milliseconds from the creation of the segment.
+// Data is kept in the separate map of the segment, so caches without data (tx, sn) do not pay for it
+type cacheEntry struct {
+	sources      SourceSet
+	firstSeen    uint32
+	lastSeen     uint32
+	weight       float32
+	visits       byte
+	firstVisitId byte
+}
+
 type cacheSegment struct {
 	ebuffer.ExpiringSegmentBase
-	themap map[string]CacheEntry
+	themap map[HashKey]cacheEntry
+	data   map[HashKey]interface{} // created with the first entry with data
+	stats  segmentStats
 }
 
 type HashCacheBase struct {
@@ -23,12 +123,13 @@ type HashCacheBase struct {
 	hashLen               int
 	segmentDurationMsCopy uint64
 	retentionPeriodMsCopy uint64
+	codec                 DataCodec // used to save and restore data of entries in snapshots
 }
 
 var segmentConstructor = func(prev ebuffer.ExpiringSegment) ebuffer.ExpiringSegment {
 	ret := &cacheSegment{
 		ExpiringSegmentBase: *ebuffer.NewExpiringSegmentBase(),
-		themap:              make(map[string]CacheEntry),
+		themap:              make(map[HashKey]cacheEntry),
 	}
 	ret.SetPrev(prev)
 	return ebuffer.ExpiringSegment(ret)
@@ -43,59 +144,146 @@ func NewHashCacheBase(id string, hashLen int, segmentDurationSec int, retentionP
 	}
 }
 
+// offset of the timestamp from the creation of the segment, limited to the range of uint32 (~49 days)
+func (seg *cacheSegment) toOffset(ts uint64) uint32 {
+	created, _ := seg.GetTimes()
+	switch {
+	case ts <= created:
+		return 0
+	case ts-created > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(ts - created)
+}
+
+func (seg *cacheSegment) fromOffset(offset uint32) uint64 {
+	created, _ := seg.GetTimes()
+	return created + uint64(offset)
+}
+
+func (seg *cacheSegment) toCacheEntry(key HashKey, e *cacheEntry, ret *CacheEntry) {
+	ret.FirstSeen = seg.fromOffset(e.firstSeen)
+	ret.LastSeen = seg.fromOffset(e.lastSeen)
+	ret.Visits = e.visits
+	ret.FirstVisitId = e.firstVisitId
+	ret.Weight = e.weight
+	ret.WeightBefore = e.weight
+	ret.Sources = e.sources
+	ret.Repeated = false
+	ret.Data = nil
+	if seg.data != nil {
+		ret.Data = seg.data[key]
+	}
+}
+
+// puts entry with absolute times, used when restoring segments
+func (seg *cacheSegment) putEntry(key HashKey, entry *CacheEntry) {
+	e := cacheEntry{
+		sources:      entry.Sources,
+		firstSeen:    seg.toOffset(entry.FirstSeen),
+		lastSeen:     seg.toOffset(entry.LastSeen),
+		weight:       entry.Weight,
+		visits:       entry.Visits,
+		firstVisitId: entry.FirstVisitId,
+	}
+	seg.themap[key] = e
+	seg.putData(key, entry.Data)
+	seg.stats.add(seg.fromOffset(e.firstSeen), seg.fromOffset(e.lastSeen), e.visits, e.firstVisitId)
+	seg.stats.addSources(&e.sources)
+}
+
+func (seg *cacheSegment) putData(key HashKey, data interface{}) {
+	if data == nil {
+		return
+	}
+	if seg.data == nil {
+		seg.data = make(map[HashKey]interface{})
+	}
+	seg.data[key] = data
+}
+
+// args: key, id, data, weight
 func (seg *cacheSegment) Put(args ...interface{}) {
-	shorthash := args[0].(string)
-	nowis := utils.UnixMsNow()
-	seg.themap[shorthash] = CacheEntry{
-		FirstSeen:    nowis,
-		LastSeen:     nowis,
-		Visits:       1,
-		FirstVisitId: args[1].(byte),
-		Data:         args[2],
+	key := args[0].(HashKey)
+	id := args[1].(byte)
+	nowis := seg.toOffset(utils.UnixMsNow())
+	entry := cacheEntry{
+		firstSeen:    nowis,
+		lastSeen:     nowis,
+		visits:       1,
+		firstVisitId: id,
+		weight:       args[3].(float32),
 	}
+	entry.sources.Add(id)
+	seg.themap[key] = entry
+	seg.putData(key, args[2])
+	ts := seg.fromOffset(nowis)
+	seg.stats.add(ts, ts, 1, id)
+	seg.stats.bySource[id]++
 }
 
 func (seg *cacheSegment) Size() int {
 	return len(seg.themap)
 }
 
-func (seg *cacheSegment) Find(shorthash string, ret *CacheEntry) bool {
-	return seg.findIntern(shorthash, ret, true)
+// source is id of the source or noSource
+func (seg *cacheSegment) Find(key HashKey, ret *CacheEntry, source int, weight float32) bool {
+	return seg.findIntern(key, ret, true, source, weight)
 }
 
-func (seg *cacheSegment) FindNoTouch(shorthash string, ret *CacheEntry) bool {
-	return seg.findIntern(shorthash, ret, false)
+func (seg *cacheSegment) FindNoTouch(key HashKey, ret *CacheEntry) bool {
+	return seg.findIntern(key, ret, false, noSource, 0)
 }
 
-// searches for the hash, marks if found
-func (seg *cacheSegment) findIntern(shorthash string, ret *CacheEntry, touch bool) bool {
-	entry, ok := seg.themap[shorthash]
+// searches for the hash, marks if found.
+// Repeated visit of the same source only updates LastSeen, otherwise visit counter is increased
+// and weight of the visit is added to the weight of the entry
+func (seg *cacheSegment) findIntern(key HashKey, ret *CacheEntry, touch bool, source int, weight float32) bool {
+	entry, ok := seg.themap[key]
 	if !ok {
 		return false
 	}
+	var repeated bool
+	weightBefore := entry.weight
 	if touch {
-		seg.themap[shorthash] = CacheEntry{
-			FirstSeen: entry.FirstSeen,
-			LastSeen:  utils.UnixMsNow(),
-			Visits:    entry.Visits + 1,
-			Data:      entry.Data,
+		lastSeenBefore, visitsBefore := entry.lastSeen, entry.visits
+		entry.lastSeen = seg.toOffset(utils.UnixMsNow())
+		repeated = source != noSource && !entry.sources.Add(byte(source))
+		if !repeated {
+			if source != noSource {
+				seg.stats.bySource[source]++
+			}
+			if entry.visits < 255 {
+				entry.visits++
+				entry.weight += weight
+			}
 		}
+		seg.themap[key] = entry
+		seg.stats.visited(seg.fromOffset(entry.firstSeen), seg.fromOffset(lastSeenBefore), seg.fromOffset(entry.lastSeen),
+			visitsBefore, entry.visits, entry.firstVisitId)
 	}
 	if ret != nil {
-		*ret = seg.themap[shorthash]
+		seg.toCacheEntry(key, &entry, ret)
+		ret.WeightBefore = weightBefore
+		ret.Repeated = repeated
 	}
 	return true
 }
 
-func (seg *cacheSegment) FindWithDelete(shorthash string, ret *CacheEntry) bool {
-	entry, ok := seg.themap[shorthash]
+func (seg *cacheSegment) FindWithDelete(key HashKey, ret *CacheEntry) bool {
+	entry, ok := seg.themap[key]
 	if !ok {
 		return false
 	}
 	if ret != nil {
-		*ret = entry
+		seg.toCacheEntry(key, &entry, ret)
+	}
+	delete(seg.themap, key)
+	if seg.data != nil {
+		delete(seg.data, key)
 	}
-	delete(seg.themap, shorthash)
+	seg.stats.deleted(seg.fromOffset(entry.firstSeen), seg.fromOffset(entry.lastSeen), entry.visits, entry.firstVisitId,
+		&entry.sources)
 	return true
 }
 
@@ -109,21 +297,42 @@ func (cache *HashCacheBase) ShortHash(hash string) string {
 	return string(ret)
 }
 
-func (cache *HashCacheBase) InsertNewNolock(shorthash string, id byte, data interface{}) {
-	cache.NewEntry(shorthash, id, data)
+// returns key of the hash in the cache. Only the prefix of the hash is used
+func (cache *HashCacheBase) HashKey(hash string) HashKey {
+	if cache.hashLen != 0 && len(hash) > cache.hashLen {
+		hash = hash[:cache.hashLen]
+	}
+	if len(hash) <= maxPackedTrytes {
+		if ret, ok := packTrytes(hash); ok {
+			return ret
+		}
+	}
+	return hashFNV(hash)
+}
+
+func (cache *HashCacheBase) InsertNewNolock(key HashKey, id byte, data interface{}) {
+	cache.insertNewWeightedNolock(key, id, 1, data)
 }
 
-// finds entry and increases visit counter if found
-func (cache *HashCacheBase) FindNolock(shorthash string, ret *CacheEntry, touch bool) bool {
+func (cache *HashCacheBase) insertNewWeightedNolock(key HashKey, id byte, weight float32, data interface{}) {
+	cache.NewEntry(key, id, data, weight)
+}
+
+// finds entry and increases visit counter if found. The visit is not attributed to any source
+func (cache *HashCacheBase) FindNolock(key HashKey, ret *CacheEntry, touch bool) bool {
+	return cache.findWeightedNolock(key, ret, touch, noSource, 1)
+}
+
+func (cache *HashCacheBase) findWeightedNolock(key HashKey, ret *CacheEntry, touch bool, source int, weight float32) bool {
 	var found bool
 	if touch {
 		cache.ForEachSegment__(func(seg ebuffer.ExpiringSegment) bool {
-			found = seg.(*cacheSegment).Find(shorthash, ret)
+			found = seg.(*cacheSegment).Find(key, ret, source, weight)
 			return !found // stop traversing when found
 		})
 	} else {
 		cache.ForEachSegment__(func(seg ebuffer.ExpiringSegment) bool {
-			found = seg.(*cacheSegment).FindNoTouch(shorthash, ret)
+			found = seg.(*cacheSegment).FindNoTouch(key, ret)
 			return !found // stop traversing when found
 		})
 	}
@@ -133,23 +342,23 @@ func (cache *HashCacheBase) FindNolock(shorthash string, ret *CacheEntry, touch
 func (cache *HashCacheBase) Find(hash string, ret *CacheEntry) bool {
 	cache.Lock()
 	defer cache.Unlock()
-	return cache.FindNolock(cache.ShortHash(hash), ret, true)
+	return cache.FindNolock(cache.HashKey(hash), ret, true)
 }
 
 func (cache *HashCacheBase) FindNoTouch(hash string, ret *CacheEntry) bool {
 	cache.Lock()
 	defer cache.Unlock()
-	return cache.FindNolock(cache.ShortHash(hash), ret, false)
+	return cache.FindNolock(cache.HashKey(hash), ret, false)
 }
 
 func (cache *HashCacheBase) FindNoTouch__(hash string, ret *CacheEntry) bool {
-	return cache.FindNolock(cache.ShortHash(hash), ret, false)
+	return cache.FindNolock(cache.HashKey(hash), ret, false)
 }
 
-func (cache *HashCacheBase) __findWithDelete(shorthash string, ret *CacheEntry) bool {
+func (cache *HashCacheBase) __findWithDelete(key HashKey, ret *CacheEntry) bool {
 	var found bool
 	cache.ForEachSegment__(func(seg ebuffer.ExpiringSegment) bool {
-		if seg.(*cacheSegment).FindWithDelete(shorthash, ret) {
+		if seg.(*cacheSegment).FindWithDelete(key, ret) {
 			found = true
 			return false // stop traversing, it was found
 		}
@@ -163,22 +372,25 @@ func (cache *HashCacheBase) FindWithDelete(hash string, ret *CacheEntry) bool {
 	cache.Lock()
 	defer cache.Unlock()
 
-	shash := cache.ShortHash(hash)
-	return cache.__findWithDelete(shash, ret)
+	return cache.__findWithDelete(cache.HashKey(hash), ret)
 }
 
-// TODO if same message is coming several times from same source it is passed.
-//  It is incorrect but most likely not important practically
+// visits from the same source are counted once. In that case ret.Repeated is set
 
 func (cache *HashCacheBase) SeenHashBy(hash string, id byte, data interface{}, ret *CacheEntry) bool {
+	return cache.SeenHashByWeighted(hash, id, 1, data, ret)
+}
+
+// same as SeenHashBy, the visit adds 'weight' to the weight of the entry
+func (cache *HashCacheBase) SeenHashByWeighted(hash string, id byte, weight float32, data interface{}, ret *CacheEntry) bool {
 	cache.Lock()
 	defer cache.Unlock()
 
-	shash := cache.ShortHash(hash)
-	if seen := cache.FindNolock(shash, ret, true); seen {
+	key := cache.HashKey(hash)
+	if seen := cache.findWeightedNolock(key, ret, true, int(id), weight); seen {
 		return true
 	}
-	cache.InsertNewNolock(shash, id, data)
+	cache.insertNewWeightedNolock(key, id, weight, data)
 	// if new entry, ret is not touched
 	// CacheEntry is mock
 	if ret != nil {
@@ -186,75 +398,24 @@ func (cache *HashCacheBase) SeenHashBy(hash string, id byte, data interface{}, r
 		ret.Visits = 1
 		ret.LastSeen = nowis
 		ret.FirstSeen = nowis
+		ret.Weight = weight
+		ret.WeightBefore = 0
 		ret.Data = data
 		ret.FirstVisitId = id
+		ret.Sources = SourceSet{}
+		ret.Sources.Add(id)
+		ret.Repeated = false
 	}
 	return false
 }
 
-type hashcacheStats struct {
-	TxCount          int
-	TxCountOlder1Min int
-	TxCountPassed    int
-	SeenOnce         int
-	LatencySecAvg    float64
-	EarliestSeen     uint64
-	SeenOnceRateById map[byte]int
-}
-
-func (cache *HashCacheBase) Stats(msecBack uint64, quorumTx int) *hashcacheStats {
-	nowis := utils.UnixMsNow()
-	earliest := nowis - msecBack
-	ago1min := nowis - 10*60*1000
-
-	if msecBack == 0 {
-		earliest = 0 // count all of it
-	}
-	ret := &hashcacheStats{
-		EarliestSeen:     utils.UnixMsNow(),
-		SeenOnceRateById: make(map[byte]int),
-	}
-	totalCount5to1MinById := make(map[byte]int)
-	var lat float64
-	var ok bool
-	cache.ForEachEntry(func(entry *CacheEntry) {
-		ret.TxCount++
-		// counting only those seenOnce, which are older than 1 min
-		if entry.FirstSeen <= ago1min {
-			ret.TxCountOlder1Min++
-
-			if _, ok = totalCount5to1MinById[entry.FirstVisitId]; !ok {
-				totalCount5to1MinById[entry.FirstVisitId] = 0
-			}
-			totalCount5to1MinById[entry.FirstVisitId] += 1
-			if entry.Visits == 1 {
-				ret.SeenOnce++
-				if _, ok = ret.SeenOnceRateById[entry.FirstVisitId]; !ok {
-					ret.SeenOnceRateById[entry.FirstVisitId] = 0
-				}
-				ret.SeenOnceRateById[entry.FirstVisitId] += 1
-			}
-		}
-		if int(entry.Visits) >= quorumTx {
-			lat = float64(entry.LastSeen-entry.FirstSeen) / 1000
-			ret.LatencySecAvg += lat
-			ret.TxCountPassed++
-		}
-		if entry.LastSeen < ret.EarliestSeen {
-			ret.EarliestSeen = entry.LastSeen
-		}
-	}, earliest, true)
-
-	for id := range ret.SeenOnceRateById {
-		ret.SeenOnceRateById[id] = (ret.SeenOnceRateById[id] * 100) / totalCount5to1MinById[id]
+// returns ids of sources which have seen the hash
+func (cache *HashCacheBase) SeenBy(hash string) ([]byte, bool) {
+	var entry CacheEntry
+	if !cache.FindNoTouch(hash, &entry) {
+		return nil, false
 	}
-
-	if ret.TxCountPassed != 0 {
-		ret.LatencySecAvg = ret.LatencySecAvg / float64(ret.TxCountPassed)
-	} else {
-		ret.LatencySecAvg = 0
-	}
-	return ret
+	return entry.Sources.Ids(), true
 }
 
 func (cache *HashCacheBase) ForEachEntry(callback func(entry *CacheEntry), earliest uint64, lock bool) uint64 {
@@ -263,10 +424,12 @@ func (cache *HashCacheBase) ForEachEntry(callback func(entry *CacheEntry), earli
 		defer cache.Unlock()
 	}
 	retEarliest := utils.UnixMsNow()
+	var entry CacheEntry
 	cache.ForEachSegment__(func(s ebuffer.ExpiringSegment) bool {
 		seg := s.(*cacheSegment)
-		for _, entry := range seg.themap {
-			if entry.LastSeen >= earliest {
+		for key, e := range seg.themap {
+			if seg.fromOffset(e.lastSeen) >= earliest {
+				seg.toCacheEntry(key, &e, &entry)
 				callback(&entry)
 				if entry.LastSeen < retEarliest {
 					retEarliest = entry.LastSeen
@@ -277,3 +440,16 @@ func (cache *HashCacheBase) ForEachEntry(callback func(entry *CacheEntry), earli
 	})
 	return retEarliest
 }
+
+// returns copies of entries seen not earlier than 'earliest'. The cache is locked only while copying
+func (cache *HashCacheBase) CopyEntries(earliest uint64) []CacheEntry {
+	cache.Lock()
+	defer cache.Unlock()
+
+	_, numentries := cache.sizeNolock()
+	ret := make([]CacheEntry, 0, numentries)
+	cache.ForEachEntry(func(entry *CacheEntry) {
+		ret = append(ret, *entry)
+	}, earliest, false)
+	return ret
+}
@@ -0,0 +1,409 @@
+package hashcache
+
+import (
+	"github.com/unioproject/tanglebeat/lib/ebuffer"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func Test_SourceSet(t *testing.T) {
+	var ss SourceSet
+	ids := []byte{0, 1, 63, 64, 127, 200, 255}
+	for _, id := range ids {
+		if !ss.Add(id) {
+			t.Errorf("id %v expected to be new", id)
+		}
+	}
+	for _, id := range ids {
+		if ss.Add(id) {
+			t.Errorf("id %v expected to be in the set", id)
+		}
+	}
+	if ss.Contains(2) || ss.Contains(254) {
+		t.Errorf("unexpected id in the set")
+	}
+	if ss.Count() != len(ids) {
+		t.Errorf("expected count %v, got %v", len(ids), ss.Count())
+	}
+	ret := ss.Ids()
+	if len(ret) != len(ids) {
+		t.Fatalf("expected %v ids, got %v", len(ids), len(ret))
+	}
+	for i := range ids {
+		if ret[i] != ids[i] {
+			t.Errorf("expected ids %v, got %v", ids, ret)
+			break
+		}
+	}
+}
+
+func Test_SeenHashByDistinctSources(t *testing.T) {
+	cache := NewHashCacheBase("testcache", 0, 10, 60)
+	var entry CacheEntry
+	hash := "TESTHASH9999"
+
+	if cache.SeenHashBy(hash, 5, nil, &entry) {
+		t.Errorf("hash expected to be new")
+	}
+	cache.SeenHashBy(hash, 5, nil, &entry)
+	if !entry.Repeated || entry.Visits != 1 || entry.Weight != 1 {
+		t.Errorf("repeated visit from the same source must not be counted: %+v", entry)
+	}
+	cache.SeenHashByWeighted(hash, 7, 0.5, nil, &entry)
+	if entry.Repeated || entry.Visits != 2 || entry.Weight != 1.5 {
+		t.Errorf("visit from new source must be counted: %+v", entry)
+	}
+	cache.SeenHashByWeighted(hash, 7, 0.5, nil, &entry)
+	if !entry.Repeated || entry.Visits != 2 || entry.Weight != 1.5 {
+		t.Errorf("repeated visit from the same source must not be counted: %+v", entry)
+	}
+	if entry.FirstVisitId != 5 {
+		t.Errorf("first visit id lost: %+v", entry)
+	}
+	ids, ok := cache.SeenBy(hash)
+	if !ok || len(ids) != 2 || ids[0] != 5 || ids[1] != 7 {
+		t.Errorf("expected sources [5 7], got %v", ids)
+	}
+	// visits without source are counted each time
+	cache.Find(hash, &entry)
+	cache.Find(hash, &entry)
+	if entry.Visits != 4 {
+		t.Errorf("expected 4 visits, got %v", entry.Visits)
+	}
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(data interface{}) ([]byte, error) {
+	return []byte(data.(string)), nil
+}
+
+func (stringCodec) Decode(buf []byte) (interface{}, error) {
+	return string(buf), nil
+}
+
+func Test_SnapshotRoundTrip(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testcache.snapshot")
+	cache := NewHashCacheBase("testcache", 0, 10, 60)
+	cache.SetDataCodec(stringCodec{})
+	for i := 0; i < 10; i++ {
+		cache.SeenHashBy("HASH"+strconv.Itoa(i), 1, "data"+strconv.Itoa(i), nil)
+	}
+	cache.SeenHashByWeighted("HASH0", 2, 0.5, nil, nil)
+
+	num, err := cache.SaveSnapshot(fname, map[byte]string{1: "in1", 2: "in2"})
+	if err != nil || num != 10 {
+		t.Fatalf("expected 10 entries saved, got %v, err = %v", num, err)
+	}
+
+	restored := NewHashCacheBase("testcache", 0, 10, 60)
+	restored.SetDataCodec(stringCodec{})
+	num, err = restored.LoadSnapshot(fname, nil)
+	if err != nil || num != 10 {
+		t.Fatalf("expected 10 entries restored, got %v, err = %v", num, err)
+	}
+	var entry CacheEntry
+	if !restored.FindNoTouch("HASH0", &entry) {
+		t.Fatalf("restored entry not found")
+	}
+	if entry.Visits != 2 || entry.Weight != 1.5 || entry.Data.(string) != "data0" || !entry.Sources.Contains(2) {
+		t.Errorf("restored entry differs: %+v", entry)
+	}
+	// snapshot can't be loaded into the cache with another id or into not empty cache
+	if _, err = NewHashCacheBase("othercache", 0, 10, 60).LoadSnapshot(fname, nil); err == nil {
+		t.Errorf("expected error loading snapshot of another cache")
+	}
+	if _, err = restored.LoadSnapshot(fname, nil); err == nil {
+		t.Errorf("expected error loading snapshot into not empty cache")
+	}
+}
+
+func Test_SnapshotRemapsSourceIds(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "testcache.snapshot")
+	cache := NewHashCacheBase("testcache", 0, 10, 60)
+	cache.SeenHashBy("HASH0", 1, nil, nil)
+	cache.SeenHashBy("HASH0", 2, nil, nil)
+	cache.SeenHashBy("HASH1", 2, nil, nil)
+	cache.SeenHashBy("HASH2", 1, nil, nil)
+	if _, err := cache.SaveSnapshot(fname, map[byte]string{1: "in1", 2: "in2"}); err != nil {
+		t.Fatalf("saving snapshot: %v", err)
+	}
+
+	// after restart 'in1' has id 5, 'in2' is unknown
+	restored := NewHashCacheBase("testcache", 0, 10, 60)
+	num, err := restored.LoadSnapshot(fname, func(id byte, name string) (byte, bool) {
+		return 5, name == "in1"
+	})
+	if err != nil || num != 2 {
+		t.Fatalf("expected 2 entries restored, got %v, err = %v", num, err)
+	}
+	var entry CacheEntry
+	if !restored.FindNoTouch("HASH0", &entry) {
+		t.Fatalf("HASH0 not restored")
+	}
+	if entry.Visits != 2 || entry.FirstVisitId != 5 || entry.Sources.Count() != 1 || !entry.Sources.Contains(5) {
+		t.Errorf("HASH0 expected to be seen by 5 only with 2 visits, got %+v", entry)
+	}
+	if restored.FindNoTouch("HASH1", &entry) {
+		t.Errorf("HASH1 first seen by unknown source must not be restored")
+	}
+	if !restored.FindNoTouch("HASH2", &entry) || entry.FirstVisitId != 5 || !entry.Sources.Contains(5) {
+		t.Errorf("HASH2 expected to be seen by 5, got %+v", entry)
+	}
+}
+
+func Test_HashKey(t *testing.T) {
+	cache := NewHashCacheBase("testcache", 12, 10, 60)
+	hash := "ABCDEFGHIJKL9MNOPQRSTUVWXYZ"
+	if cache.HashKey(hash) != cache.HashKey(hash[:12]+"999") {
+		t.Errorf("only prefix of the hash must be used in the key")
+	}
+	if cache.HashKey(hash)&hashedKeyFlag != 0 {
+		t.Errorf("tryte prefix expected to be packed")
+	}
+	if cache.HashKey("A") == cache.HashKey("9A") {
+		t.Errorf("prefixes of different length must have different keys")
+	}
+	if cache.HashKey("not trytes")&hashedKeyFlag == 0 {
+		t.Errorf("not tryte strings expected to be hashed")
+	}
+	full := NewHashCacheBase("testcache", 0, 10, 60)
+	if full.HashKey(hash)&hashedKeyFlag == 0 || full.HashKey(hash) == full.HashKey(hash[:26]+"A") {
+		t.Errorf("long hashes expected to be hashed as a whole")
+	}
+}
+
+//---------------- benchmarks: binary keys and compact entries vs string keys and full entries
+
+const (
+	benchHashes  = 100000
+	benchHashLen = 12
+)
+
+var benchHashList = func() []string {
+	const trytes = "9ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	rnd := rand.New(rand.NewSource(1))
+	ret := make([]string, benchHashes)
+	buf := make([]byte, 81)
+	for i := range ret {
+		for j := range buf {
+			buf[j] = trytes[rnd.Intn(len(trytes))]
+		}
+		ret[i] = string(buf)
+	}
+	return ret
+}()
+
+// layout of the cache entry with string keys, as it was before binary keys
+type stringKeyEntry struct {
+	FirstSeen    uint64
+	LastSeen     uint64
+	Visits       byte
+	FirstVisitId byte
+	Weight       float32
+	Sources      SourceSet
+	Repeated     bool
+	Data         interface{}
+}
+
+func shortHashCopy(hash string) string {
+	ret := make([]byte, benchHashLen)
+	copy(ret, hash[:benchHashLen])
+	return string(ret)
+}
+
+func fillStringKeyMap() map[string]stringKeyEntry {
+	ret := make(map[string]stringKeyEntry)
+	for _, h := range benchHashList {
+		ret[shortHashCopy(h)] = stringKeyEntry{Visits: 1, Weight: 1}
+	}
+	return ret
+}
+
+func fillBinaryKeyMap(cache *HashCacheBase) map[HashKey]cacheEntry {
+	ret := make(map[HashKey]cacheEntry)
+	for _, h := range benchHashList {
+		ret[cache.HashKey(h)] = cacheEntry{visits: 1, weight: 1}
+	}
+	return ret
+}
+
+// heap retained by the result of fill, per entry
+func retainedPerEntry(fill func() interface{}) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	ret := fill()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(ret)
+	return float64(after.HeapAlloc-before.HeapAlloc) / benchHashes
+}
+
+func Benchmark_FillStringKeys(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fillStringKeyMap()
+	}
+	b.ReportMetric(retainedPerEntry(func() interface{} { return fillStringKeyMap() }), "bytes/entry")
+}
+
+func Benchmark_FillBinaryKeys(b *testing.B) {
+	cache := NewHashCacheBase("bench", benchHashLen, 60, 600)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fillBinaryKeyMap(cache)
+	}
+	b.ReportMetric(retainedPerEntry(func() interface{} { return fillBinaryKeyMap(cache) }), "bytes/entry")
+}
+
+func Benchmark_LookupStringKeys(b *testing.B) {
+	m := fillStringKeyMap()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[shortHashCopy(benchHashList[i%benchHashes])]
+	}
+}
+
+func Benchmark_LookupBinaryKeys(b *testing.B) {
+	cache := NewHashCacheBase("bench", benchHashLen, 60, 600)
+	m := fillBinaryKeyMap(cache)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[cache.HashKey(benchHashList[i%benchHashes])]
+	}
+}
+
+func Benchmark_SeenHashBy(b *testing.B) {
+	cache := NewHashCacheBase("bench", benchHashLen, 60, 600)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cache.SeenHashBy(benchHashList[i%benchHashes], byte(i%50), nil, nil)
+	}
+}
+
+func Test_ShardedHashCache(t *testing.T) {
+	sharded := NewShardedHashCache("testcache", 8, 12, 10, 60)
+	single := NewHashCacheBase("testcache", 12, 10, 60)
+	used := make(map[int]bool)
+	for i, h := range benchHashList[:1000] {
+		sharded.SeenHashBy(h, byte(i%3), nil, nil)
+		single.SeenHashBy(h, byte(i%3), nil, nil)
+		if i%2 == 0 {
+			sharded.SeenHashBy(h, 5, nil, nil)
+			single.SeenHashBy(h, 5, nil, nil)
+		}
+		if sharded.ShardOf(h) != sharded.ShardOf(h[:12]) {
+			t.Fatalf("shard must depend only on the prefix of the hash")
+		}
+		used[sharded.ShardOf(h)] = true
+	}
+	if len(used) != sharded.NumShards() {
+		t.Errorf("expected all %v shards used, got %v", sharded.NumShards(), len(used))
+	}
+	if _, n := sharded.Size(); n != 1000 {
+		t.Errorf("expected 1000 entries, got %v", n)
+	}
+	var entry CacheEntry
+	if !sharded.FindNoTouch(benchHashList[0], &entry) || entry.Visits != 2 {
+		t.Errorf("expected entry with 2 visits, got %+v", entry)
+	}
+	s1 := sharded.Stats(0, 2)
+	s2 := single.Stats(0, 2)
+	if s1.TxCount != s2.TxCount || s1.TxCountPassed != s2.TxCountPassed || s1.SeenOnce != s2.SeenOnce {
+		t.Errorf("stats of sharded cache differ: %+v != %+v", s1, s2)
+	}
+	if NewShardedHashCache("testcache", 1, 12, 10, 60).Shards()[0].GetID() != "testcache" {
+		t.Errorf("single shard must have id of the cache")
+	}
+}
+
+// cache with segments for the last 90 minutes. Some entries are seen long after they were created
+func newCacheWithHistory() *HashCacheBase {
+	cache := NewHashCacheBase("testcache", 12, 60, 2*60*60)
+	rnd := rand.New(rand.NewSource(2))
+	nowis := utils.UnixMsNow()
+	var h int
+
+	cache.Lock()
+	for m := 90; m >= 0; m-- {
+		seg := segmentConstructor(nil).(*cacheSegment)
+		created := nowis - uint64(m)*60*1000
+		seg.SetTimes(created, created)
+		for i := 0; i < 50; i++ {
+			entry := CacheEntry{
+				FirstSeen:    created + uint64(rnd.Intn(60*1000)),
+				Visits:       byte(1 + rnd.Intn(5)),
+				FirstVisitId: byte(rnd.Intn(4)),
+			}
+			entry.LastSeen = entry.FirstSeen
+			if rnd.Intn(3) == 0 {
+				entry.LastSeen += uint64(rnd.Intn(m*60*1000 + 1))
+			}
+			if entry.FirstSeen > nowis {
+				entry.FirstSeen = nowis
+			}
+			if entry.LastSeen > nowis {
+				entry.LastSeen = nowis
+			}
+			if entry.LastSeen > seg.stats.maxLastSeen {
+				seg.SetTimes(created, entry.LastSeen)
+			}
+			entry.Sources.Add(entry.FirstVisitId)
+			for id := byte(10); entry.Sources.Count() < int(entry.Visits); id++ {
+				entry.Sources.Add(id)
+			}
+			seg.putEntry(cache.HashKey(benchHashList[h]), &entry)
+			h++
+		}
+		cache.RestoreSegment__(seg)
+	}
+	cache.Unlock()
+	return cache
+}
+
+func Test_StatsAggregatesEqualScan(t *testing.T) {
+	cache := newCacheWithHistory()
+	// visits and deletes after the entries were created
+	for i := 0; i < 4000; i += 37 {
+		cache.SeenHashBy(benchHashList[i], byte(20+i%3), nil, nil)
+	}
+	for i := 5; i < 4000; i += 101 {
+		cache.FindWithDelete(benchHashList[i], nil)
+	}
+	for _, msecBack := range []uint64{0, 5 * 60 * 1000, 10 * 60 * 1000, 60 * 60 * 1000} {
+		for quorum := 1; quorum <= 3; quorum++ {
+			acc := newStatsAccumulator(msecBack, quorum)
+			ref := newStatsAccumulator(msecBack, quorum)
+			ref.earliest, ref.ago1min, ref.ret.EarliestSeen = acc.earliest, acc.ago1min, acc.ret.EarliestSeen
+
+			cache.accumulateStats(acc)
+			cache.ForEachEntry(ref.addEntry, ref.earliest, true)
+			got, expected := acc.result(), ref.result()
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("msecBack = %v, quorum = %v: stats from aggregates %+v, full scan %+v",
+					msecBack, quorum, got, expected)
+			}
+		}
+	}
+	// most of segments must be summed without walking entries
+	acc := newStatsAccumulator(0, 2)
+	var summed, total int
+	cache.ForEachSegment__(func(s ebuffer.ExpiringSegment) bool {
+		total++
+		if acc.addSegment(s.(*cacheSegment)) {
+			summed++
+		}
+		return true
+	})
+	if summed < total/2 {
+		t.Errorf("only %v segments of %v are summed from aggregates", summed, total)
+	}
+}
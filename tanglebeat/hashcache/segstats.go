@@ -0,0 +1,246 @@
+package hashcache
+
+import (
+	"github.com/unioproject/tanglebeat/lib/ebuffer"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"math"
+)
+
+// Each segment keeps running aggregates of its entries, updated on insert, visit and delete.
+// Stats sums aggregates of segments instead of walking all entries.
+// Entries of the segment are only walked when the segment is on the border of the time window,
+// i.e. some of its entries are inside the window and some are not. Results are the same as of the full scan
+
+type segmentStats struct {
+	count        int
+	minFirstSeen uint64 // bounds of FirstSeen of entries, not narrowed on delete
+	maxFirstSeen uint64
+	maxLastSeen  uint64 // bound of LastSeen of entries, not narrowed on delete
+	minLastSeen  uint64 // valid only if not minDirty
+	minDirty     bool   // entry with minimal LastSeen was visited or deleted
+	byVisits     [256]int32
+	latencyMs    [256]uint64 // sum of LastSeen - FirstSeen of entries by number of visits
+	seenOnceById [256]int32  // entries seen once by FirstVisitId
+	bySource     [256]int32  // entries seen by the source
+}
+
+func (st *segmentStats) add(firstSeen, lastSeen uint64, visits, firstVisitId byte) {
+	if st.count == 0 || firstSeen < st.minFirstSeen {
+		st.minFirstSeen = firstSeen
+	}
+	if st.count == 0 || lastSeen < st.minLastSeen {
+		st.minLastSeen = lastSeen
+	}
+	if firstSeen > st.maxFirstSeen {
+		st.maxFirstSeen = firstSeen
+	}
+	if lastSeen > st.maxLastSeen {
+		st.maxLastSeen = lastSeen
+	}
+	st.count++
+	st.addVisits(firstSeen, lastSeen, visits, firstVisitId)
+}
+
+func (st *segmentStats) addVisits(firstSeen, lastSeen uint64, visits, firstVisitId byte) {
+	st.byVisits[visits]++
+	st.latencyMs[visits] += lastSeen - firstSeen
+	if visits == 1 {
+		st.seenOnceById[firstVisitId]++
+	}
+}
+
+func (st *segmentStats) removeVisits(firstSeen, lastSeen uint64, visits, firstVisitId byte) {
+	st.byVisits[visits]--
+	st.latencyMs[visits] -= lastSeen - firstSeen
+	if visits == 1 {
+		st.seenOnceById[firstVisitId]--
+	}
+}
+
+func (st *segmentStats) addSources(sources *SourceSet) {
+	sources.ForEach(func(id byte) {
+		st.bySource[id]++
+	})
+}
+
+// entry changed with the visit
+func (st *segmentStats) visited(firstSeen, lastSeenBefore, lastSeen uint64, visitsBefore, visits, firstVisitId byte) {
+	st.removeVisits(firstSeen, lastSeenBefore, visitsBefore, firstVisitId)
+	st.addVisits(firstSeen, lastSeen, visits, firstVisitId)
+	switch {
+	case lastSeen < st.minLastSeen:
+		st.minLastSeen = lastSeen
+	case lastSeenBefore == st.minLastSeen && lastSeen != lastSeenBefore:
+		st.minDirty = true
+	}
+	if lastSeen > st.maxLastSeen {
+		st.maxLastSeen = lastSeen
+	}
+}
+
+func (st *segmentStats) deleted(firstSeen, lastSeen uint64, visits, firstVisitId byte, sources *SourceSet) {
+	st.count--
+	st.removeVisits(firstSeen, lastSeen, visits, firstVisitId)
+	sources.ForEach(func(id byte) {
+		st.bySource[id]--
+	})
+	if lastSeen == st.minLastSeen {
+		st.minDirty = true
+	}
+}
+
+// recalculates minimal LastSeen if needed. Normally only the newest segments are visited often enough for that
+func (seg *cacheSegment) minLastSeen() uint64 {
+	if seg.stats.minDirty {
+		var minOffset uint32 = math.MaxUint32
+		for _, e := range seg.themap {
+			if e.lastSeen < minOffset {
+				minOffset = e.lastSeen
+			}
+		}
+		seg.stats.minLastSeen = seg.fromOffset(minOffset)
+		seg.stats.minDirty = false
+	}
+	return seg.stats.minLastSeen
+}
+
+type hashcacheStats struct {
+	TxCount          int
+	TxCountOlder1Min int
+	TxCountPassed    int
+	SeenOnce         int
+	LatencySecAvg    float64
+	EarliestSeen     uint64
+	SeenOnceRateById map[byte]int
+}
+
+// collects sums of stats from segments (possibly of several caches) or from single entries
+type statsAccumulator struct {
+	earliest              uint64
+	ago1min               uint64
+	quorumTx              int
+	ret                   *hashcacheStats
+	latencyMs             uint64
+	totalCount5to1MinById [256]int
+}
+
+func newStatsAccumulator(msecBack uint64, quorumTx int) *statsAccumulator {
+	nowis := utils.UnixMsNow()
+	ret := &statsAccumulator{
+		earliest: nowis - msecBack,
+		ago1min:  nowis - 10*60*1000,
+		quorumTx: quorumTx,
+		ret: &hashcacheStats{
+			EarliestSeen:     nowis,
+			SeenOnceRateById: make(map[byte]int),
+		},
+	}
+	if msecBack == 0 {
+		ret.earliest = 0 // count all of it
+	}
+	return ret
+}
+
+func (acc *statsAccumulator) addEntry(entry *CacheEntry) {
+	ret := acc.ret
+	ret.TxCount++
+	// counting only those seenOnce, which are older than 1 min
+	if entry.FirstSeen <= acc.ago1min {
+		ret.TxCountOlder1Min++
+
+		// rate of the source is relative to all hashes seen by the source
+		entry.Sources.ForEach(func(id byte) {
+			acc.totalCount5to1MinById[id]++
+		})
+		if entry.Visits == 1 {
+			ret.SeenOnce++
+			ret.SeenOnceRateById[entry.FirstVisitId]++
+		}
+	}
+	if int(entry.Visits) >= acc.quorumTx {
+		acc.latencyMs += entry.LastSeen - entry.FirstSeen
+		ret.TxCountPassed++
+	}
+	if entry.LastSeen < ret.EarliestSeen {
+		ret.EarliestSeen = entry.LastSeen
+	}
+}
+
+// returns false if the segment must be scanned entry by entry
+func (acc *statsAccumulator) addSegment(seg *cacheSegment) bool {
+	st := &seg.stats
+	if st.count == 0 || st.maxLastSeen < acc.earliest {
+		return true // nothing in the window
+	}
+	allOlder := st.maxFirstSeen <= acc.ago1min
+	if !allOlder && st.minFirstSeen <= acc.ago1min {
+		return false
+	}
+	minLastSeen := seg.minLastSeen()
+	if minLastSeen < acc.earliest {
+		return false
+	}
+	ret := acc.ret
+	ret.TxCount += st.count
+	if allOlder {
+		ret.TxCountOlder1Min += st.count
+		ret.SeenOnce += int(st.byVisits[1])
+		for id := range st.bySource {
+			acc.totalCount5to1MinById[id] += int(st.bySource[id])
+			if st.seenOnceById[id] != 0 {
+				ret.SeenOnceRateById[byte(id)] += int(st.seenOnceById[id])
+			}
+		}
+	}
+	from := acc.quorumTx
+	if from < 0 {
+		from = 0
+	}
+	for v := from; v < len(st.byVisits); v++ {
+		ret.TxCountPassed += int(st.byVisits[v])
+		acc.latencyMs += st.latencyMs[v]
+	}
+	if minLastSeen < ret.EarliestSeen {
+		ret.EarliestSeen = minLastSeen
+	}
+	return true
+}
+
+func (acc *statsAccumulator) result() *hashcacheStats {
+	ret := acc.ret
+	for id := range ret.SeenOnceRateById {
+		ret.SeenOnceRateById[id] = (ret.SeenOnceRateById[id] * 100) / acc.totalCount5to1MinById[id]
+	}
+	if ret.TxCountPassed != 0 {
+		ret.LatencySecAvg = float64(acc.latencyMs) / 1000 / float64(ret.TxCountPassed)
+	} else {
+		ret.LatencySecAvg = 0
+	}
+	return ret
+}
+
+func (cache *HashCacheBase) accumulateStats(acc *statsAccumulator) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	var entry CacheEntry
+	cache.ForEachSegment__(func(s ebuffer.ExpiringSegment) bool {
+		seg := s.(*cacheSegment)
+		if acc.addSegment(seg) {
+			return true
+		}
+		for key, e := range seg.themap {
+			if seg.fromOffset(e.lastSeen) >= acc.earliest {
+				seg.toCacheEntry(key, &e, &entry)
+				acc.addEntry(&entry)
+			}
+		}
+		return true
+	})
+}
+
+func (cache *HashCacheBase) Stats(msecBack uint64, quorumTx int) *hashcacheStats {
+	acc := newStatsAccumulator(msecBack, quorumTx)
+	cache.accumulateStats(acc)
+	return acc.result()
+}
@@ -0,0 +1,120 @@
+package hashcache
+
+import (
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/utils"
+)
+
+// ShardedHashCache is the hash cache split into shards by the key of the hash. Each shard is HashCacheBase
+// with its own lock, so visits of different hashes do not wait for each other.
+// Iteration (ForEachEntry, Stats) copies entries of one shard at a time and calls callbacks without lock,
+// so reporting never blocks filtering for longer than copying of one shard
+type ShardedHashCache struct {
+	id     string
+	shards []*HashCacheBase
+}
+
+// with one shard id of the shard is the same as id of the cache
+func NewShardedHashCache(id string, numShards int, hashLen int, segmentDurationSec int, retentionPeriodSec int) *ShardedHashCache {
+	if numShards < 1 {
+		numShards = 1
+	}
+	ret := &ShardedHashCache{
+		id:     id,
+		shards: make([]*HashCacheBase, numShards),
+	}
+	for i := range ret.shards {
+		shardId := id
+		if numShards > 1 {
+			shardId = fmt.Sprintf("%v-%d", id, i)
+		}
+		ret.shards[i] = NewHashCacheBase(shardId, hashLen, segmentDurationSec, retentionPeriodSec)
+	}
+	return ret
+}
+
+func (cache *ShardedHashCache) GetID() string {
+	return cache.id
+}
+
+func (cache *ShardedHashCache) Shards() []*HashCacheBase {
+	return cache.shards
+}
+
+func (cache *ShardedHashCache) NumShards() int {
+	return len(cache.shards)
+}
+
+// returns index of the shard of the hash. Same hash always goes to the same shard,
+// so it can be used to partition the work between parallel workers
+func (cache *ShardedHashCache) ShardOf(hash string) int {
+	if len(cache.shards) == 1 {
+		return 0
+	}
+	// packed keys differ mostly in lower bits, so they are mixed first
+	key := uint64(cache.shards[0].HashKey(hash)) * 0x9E3779B97F4A7C15
+	return int((key >> 32) % uint64(len(cache.shards)))
+}
+
+func (cache *ShardedHashCache) shard(hash string) *HashCacheBase {
+	return cache.shards[cache.ShardOf(hash)]
+}
+
+func (cache *ShardedHashCache) SeenHashBy(hash string, id byte, data interface{}, ret *CacheEntry) bool {
+	return cache.shard(hash).SeenHashBy(hash, id, data, ret)
+}
+
+func (cache *ShardedHashCache) SeenHashByWeighted(hash string, id byte, weight float32, data interface{}, ret *CacheEntry) bool {
+	return cache.shard(hash).SeenHashByWeighted(hash, id, weight, data, ret)
+}
+
+func (cache *ShardedHashCache) Find(hash string, ret *CacheEntry) bool {
+	return cache.shard(hash).Find(hash, ret)
+}
+
+func (cache *ShardedHashCache) FindNoTouch(hash string, ret *CacheEntry) bool {
+	return cache.shard(hash).FindNoTouch(hash, ret)
+}
+
+func (cache *ShardedHashCache) FindWithDelete(hash string, ret *CacheEntry) bool {
+	return cache.shard(hash).FindWithDelete(hash, ret)
+}
+
+func (cache *ShardedHashCache) SeenBy(hash string) ([]byte, bool) {
+	return cache.shard(hash).SeenBy(hash)
+}
+
+// returns total number of segments and entries in all shards
+func (cache *ShardedHashCache) Size() (int, int) {
+	var numseg, numentries int
+	for _, s := range cache.shards {
+		ns, ne := s.Size()
+		numseg += ns
+		numentries += ne
+	}
+	return numseg, numentries
+}
+
+// callback is called for copies of entries, without holding locks of shards
+func (cache *ShardedHashCache) ForEachEntry(callback func(entry *CacheEntry), earliest uint64) uint64 {
+	retEarliest := utils.UnixMsNow()
+	for _, s := range cache.shards {
+		entries := s.CopyEntries(earliest)
+		for i := range entries {
+			callback(&entries[i])
+			if entries[i].LastSeen < retEarliest {
+				retEarliest = entries[i].LastSeen
+			}
+		}
+	}
+	return retEarliest
+}
+
+// aggregates of shards are summed one shard at a time
+func (cache *ShardedHashCache) Stats(msecBack uint64, quorumTx int) *hashcacheStats {
+	acc := newStatsAccumulator(msecBack, quorumTx)
+	for _, s := range cache.shards {
+		s.accumulateStats(acc)
+	}
+	return acc.result()
+}
@@ -0,0 +1,232 @@
+package hashcache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/ebuffer"
+	"os"
+)
+
+// Snapshot of the cache is saved to the file and restored upon start of the hub.
+// Data of entries is saved only if the cache has data codec.
+// Ids of sources are saved together with names of the sources, because after restart
+// the same source may get another id. Upon restore ids are translated by the remap function
+
+type DataCodec interface {
+	Encode(data interface{}) ([]byte, error)
+	Decode(buf []byte) (interface{}, error)
+}
+
+// version of the snapshot format. Snapshots of other versions are not restored
+const snapshotVersion = 1
+
+type snapshotEntry struct {
+	Key          HashKey
+	FirstSeen    uint64
+	LastSeen     uint64
+	Visits       byte
+	FirstVisitId byte
+	Weight       float32
+	Sources      SourceSet
+	Data         []byte
+}
+
+type snapshotSegment struct {
+	Created   uint64
+	LastTouch uint64
+	Entries   []snapshotEntry
+}
+
+type snapshotFile struct {
+	Version     int
+	Id          string
+	HashLen     int
+	SourceNames map[byte]string   // names of sources by id at the time of the snapshot
+	Segments    []snapshotSegment // from the oldest to the newest
+}
+
+// returns id which the source with the name and the id in the snapshot has after restart.
+// False means the id can't be restored
+type SourceIdRemap func(id byte, name string) (byte, bool)
+
+func (cache *HashCacheBase) SetDataCodec(codec DataCodec) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.codec = codec
+}
+
+// saves not expired segments to the file. Returns number of saved entries
+func (cache *HashCacheBase) SaveSnapshot(fname string, sourceNames map[byte]string) (int, error) {
+	snap, num, err := cache.makeSnapshot(sourceNames)
+	if err != nil {
+		return 0, err
+	}
+	// writing to the temporary file first, so that the previous snapshot is never corrupted
+	tmpname := fname + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return 0, err
+	}
+	if err = gob.NewEncoder(f).Encode(snap); err != nil {
+		_ = f.Close()
+		return 0, fmt.Errorf("encoding snapshot of '%v': %v", cache.GetID(), err)
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmpname, fname); err != nil {
+		return 0, err
+	}
+	return num, nil
+}
+
+func (cache *HashCacheBase) makeSnapshot(sourceNames map[byte]string) (*snapshotFile, int, error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	ret := &snapshotFile{
+		Version:     snapshotVersion,
+		Id:          cache.GetID(),
+		HashLen:     cache.hashLen,
+		SourceNames: sourceNames,
+	}
+	segments := make([]snapshotSegment, 0)
+	var num int
+	var err error
+	cache.ForEachSegment__(func(s ebuffer.ExpiringSegment) bool {
+		seg := s.(*cacheSegment)
+		snapSeg := snapshotSegment{
+			Entries: make([]snapshotEntry, 0, len(seg.themap)),
+		}
+		snapSeg.Created, snapSeg.LastTouch = seg.GetTimes()
+		var entry CacheEntry
+		for key, ce := range seg.themap {
+			seg.toCacheEntry(key, &ce, &entry)
+			e := snapshotEntry{
+				Key:          key,
+				FirstSeen:    entry.FirstSeen,
+				LastSeen:     entry.LastSeen,
+				Visits:       entry.Visits,
+				FirstVisitId: entry.FirstVisitId,
+				Weight:       entry.Weight,
+				Sources:      entry.Sources,
+			}
+			if entry.Data != nil && cache.codec != nil {
+				if e.Data, err = cache.codec.Encode(entry.Data); err != nil {
+					err = fmt.Errorf("encoding data of key %x in '%v': %v", key, cache.GetID(), err)
+					return false
+				}
+			}
+			snapSeg.Entries = append(snapSeg.Entries, e)
+		}
+		num += len(snapSeg.Entries)
+		segments = append(segments, snapSeg)
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// segments are traversed from the newest
+	for i := len(segments) - 1; i >= 0; i-- {
+		ret.Segments = append(ret.Segments, segments[i])
+	}
+	return ret, num, nil
+}
+
+// restores segments from the file into the empty cache. Expired segments are skipped.
+// Ids of sources which can't be remapped are removed from entries. Entries first seen by such source
+// are not restored. Returns number of restored entries
+func (cache *HashCacheBase) LoadSnapshot(fname string, remap SourceIdRemap) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var snap snapshotFile
+	if err = gob.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("decoding snapshot file '%v': %v", fname, err)
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("snapshot file '%v' is of version %v, expected %v", fname, snap.Version, snapshotVersion)
+	}
+	if snap.Id != cache.GetID() || snap.HashLen != cache.hashLen {
+		return 0, fmt.Errorf("snapshot file '%v' is of cache '%v' with hash length %v",
+			fname, snap.Id, snap.HashLen)
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if numseg, _ := cache.sizeNolock(); numseg != 0 {
+		return 0, fmt.Errorf("can't restore snapshot into not empty cache '%v'", cache.GetID())
+	}
+	ids := newSourceIdMap(snap.SourceNames, remap)
+	var num int
+	for _, snapSeg := range snap.Segments {
+		seg := segmentConstructor(nil).(*cacheSegment)
+		seg.SetTimes(snapSeg.Created, snapSeg.LastTouch)
+		for _, e := range snapSeg.Entries {
+			entry := CacheEntry{
+				FirstSeen:    e.FirstSeen,
+				LastSeen:     e.LastSeen,
+				Visits:       e.Visits,
+				FirstVisitId: e.FirstVisitId,
+				Weight:       e.Weight,
+			}
+			// visits without source don't have first visit id
+			if e.Sources.Count() > 0 {
+				var ok bool
+				if entry.FirstVisitId, ok = ids.remap(e.FirstVisitId); !ok {
+					continue
+				}
+				e.Sources.ForEach(func(id byte) {
+					if newId, ok := ids.remap(id); ok {
+						entry.Sources.Add(newId)
+					}
+				})
+			}
+			if e.Data != nil && cache.codec != nil {
+				if entry.Data, err = cache.codec.Decode(e.Data); err != nil {
+					return num, fmt.Errorf("decoding data of key %x in '%v': %v", e.Key, cache.GetID(), err)
+				}
+			}
+			seg.putEntry(e.Key, &entry)
+		}
+		if cache.RestoreSegment__(seg) {
+			num += seg.Size()
+		}
+	}
+	return num, nil
+}
+
+// translation of source ids of the snapshot. Ids without name are not restored
+type sourceIdMap struct {
+	newIds [256]byte
+	ok     [256]bool
+}
+
+func newSourceIdMap(names map[byte]string, remap SourceIdRemap) *sourceIdMap {
+	ret := &sourceIdMap{}
+	for id, name := range names {
+		if remap == nil {
+			ret.newIds[id], ret.ok[id] = id, true
+			continue
+		}
+		ret.newIds[id], ret.ok[id] = remap(id, name)
+	}
+	return ret
+}
+
+func (m *sourceIdMap) remap(id byte) (byte, bool) {
+	return m.newIds[id], m.ok[id]
+}
+
+func (cache *HashCacheBase) sizeNolock() (int, int) {
+	var numseg, numentries int
+	cache.ForEachSegment__(func(s ebuffer.ExpiringSegment) bool {
+		numseg++
+		numentries += s.Size()
+		return true
+	})
+	return numseg, numentries
+}
@@ -0,0 +1,154 @@
+package inputpart
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// value bundles as they are seen by the hub: reconstructed from value transactions of the output stream
+// and marked confirmed by sn messages. Bundles are kept in the cache for the retention period
+
+type bundleTxResponse struct {
+	Index   int    `json:"index"`
+	Address string `json:"address,omitempty"`
+	Value   int64  `json:"value"`
+	Seen    bool   `json:"seen"`
+}
+
+type bundleResponse struct {
+	Bundle       string             `json:"bundle"`
+	Transactions []bundleTxResponse `json:"transactions"`
+	Complete     bool               `json:"complete"` // all value transactions were seen
+	Inconsistent bool               `json:"inconsistent"`
+	Value        int64              `json:"value"` // value moved, 0 until the bundle is complete and balanced
+	Confirmed    bool               `json:"confirmed"`
+	FirstSeen    uint64             `json:"firstSeen"`
+	ConfirmedTs  uint64             `json:"confirmedTs,omitempty"`
+}
+
+const maxBundlesInResponse = 100
+
+// must be called with the cache locked. Only value transactions are known to the hub
+func makeBundleResponse(data *transferBundleData, firstSeen uint64) *bundleResponse {
+	ret := &bundleResponse{
+		Bundle:       data.hash,
+		Transactions: make([]bundleTxResponse, 0, len(data.entries)),
+		Complete:     true,
+		Inconsistent: data.inconsistent,
+		Confirmed:    data.confirmed,
+		FirstSeen:    firstSeen,
+		ConfirmedTs:  data.confirmedTs,
+	}
+	for i, e := range data.entries {
+		if e.addr == "" {
+			ret.Complete = false
+			ret.Transactions = append(ret.Transactions, bundleTxResponse{Index: i})
+			continue
+		}
+		ret.Transactions = append(ret.Transactions, bundleTxResponse{
+			Index:   i,
+			Address: e.addr,
+			Value:   e.value,
+			Seen:    true,
+		})
+	}
+	if ret.Complete && !data.inconsistent {
+		ret.Value = sumBundle(data)
+	}
+	return ret
+}
+
+func findBundle(hash string) *bundleResponse {
+	transferBundleCache.Lock()
+	defer transferBundleCache.Unlock()
+
+	var entry hashcache.CacheEntry
+	if !transferBundleCache.FindNolock(transferBundleCache.HashKey(hash), &entry, false) {
+		return nil
+	}
+	data := entry.Data.(*transferBundleData)
+	if data.hash != hash {
+		return nil // other bundle with the same key
+	}
+	return makeBundleResponse(data, entry.FirstSeen)
+}
+
+// newest first
+func findBundlesByAddress(addr string, since uint64) []*bundleResponse {
+	ret := make([]*bundleResponse, 0)
+	transferBundleCache.ForEachEntry(func(entry *hashcache.CacheEntry) {
+		if entry.FirstSeen < since {
+			return
+		}
+		data := entry.Data.(*transferBundleData)
+		for _, e := range data.entries {
+			if e.addr == addr {
+				ret = append(ret, makeBundleResponse(data, entry.FirstSeen))
+				return
+			}
+		}
+	}, since, true)
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].FirstSeen > ret[j].FirstSeen
+	})
+	if len(ret) > maxBundlesInResponse {
+		ret = ret[:maxBundlesInResponse]
+	}
+	return ret
+}
+
+// GET /api1/bundles/<hash>
+// GET /api1/bundles?address=<address>[&since=<unix ms>]
+
+func HandlerBundles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var resp interface{}
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api1/bundles"), "/")
+	if hash != "" {
+		if !zmqmsg.IsTrytesOfLen(hash, zmqmsg.HashLen) {
+			http.Error(w, fmt.Sprintf("wrong bundle hash '%v'", hash), http.StatusBadRequest)
+			return
+		}
+		bundle := findBundle(hash)
+		if bundle == nil {
+			http.Error(w, fmt.Sprintf("bundle %v not found", hash), http.StatusNotFound)
+			return
+		}
+		resp = bundle
+	} else {
+		addr := r.URL.Query().Get("address")
+		if len(addr) == zmqmsg.HashLen+9 {
+			addr = addr[:zmqmsg.HashLen] // without checksum
+		}
+		if !zmqmsg.IsTrytesOfLen(addr, zmqmsg.HashLen) {
+			http.Error(w, "expected /api1/bundles/<hash> or /api1/bundles?address=<address>", http.StatusBadRequest)
+			return
+		}
+		var since uint64
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("wrong since '%v'", s), http.StatusBadRequest)
+				return
+			}
+		}
+		resp = findBundlesByAddress(addr, since)
+	}
+	data, err := json.MarshalIndent(resp, "", "   ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error while marshaling response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
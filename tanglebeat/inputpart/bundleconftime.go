@@ -0,0 +1,59 @@
+package inputpart
+
+import (
+	"github.com/gonum/stat"
+	"github.com/unioproject/tanglebeat/lib/ebuffer"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"math"
+	"sort"
+)
+
+// confirmation time of value bundle is the time between the first tx of the bundle passed quorum
+// and the sn of it passed quorum. It is passive measurement of real transfers, complementary to
+// confirmation times of transfers sent by tbsender
+
+// stat data is seconds
+type BundleConfTimeStats struct {
+	NumSamples   int     `json:"numSamples"`
+	Mean         float64 `json:"mean"`
+	Percentile25 float64 `json:"p25"`
+	Median       float64 `json:"median"`
+	Percentile75 float64 `json:"p75"`
+	Percentile90 float64 `json:"p90"`
+}
+
+var bundleConfTimes *ebuffer.EventTsWithIntExpiringBuffer
+
+func initBundleConfTimes() {
+	bundleConfTimes = ebuffer.NewEventTsWithIntExpiringBuffer(
+		"bundleConfTimes", segmentDurationBundleCacheSec, cfg.Config.RetentionPeriodMin*60)
+}
+
+func recordBundleConfTime(msec uint64) {
+	bundleConfTimes.RecordInt(int(msec))
+	updateValueBundleConfTimeMetrics(msec)
+}
+
+func getBundleConfTimeStats(msecBack uint64) BundleConfTimeStats {
+	var ret BundleConfTimeStats
+	arr, _ := bundleConfTimes.ToFloat64(msecBack)
+	if len(arr) == 0 {
+		return ret
+	}
+	sort.Float64s(arr)
+
+	ret.NumSamples = len(arr)
+	ret.Mean = stat.Mean(arr, nil)
+	ret.Percentile25 = stat.Quantile(0.25, stat.Empirical, arr, nil)
+	ret.Median = stat.Quantile(0.5, stat.Empirical, arr, nil)
+	ret.Percentile75 = stat.Quantile(0.75, stat.Empirical, arr, nil)
+	ret.Percentile90 = stat.Quantile(0.9, stat.Empirical, arr, nil)
+
+	// convert milliseconds to seconds and round to 2 decimal places
+	ret.Mean = math.Round(ret.Mean/10) / 100
+	ret.Percentile25 = math.Round(ret.Percentile25/10) / 100
+	ret.Median = math.Round(ret.Median/10) / 100
+	ret.Percentile75 = math.Round(ret.Percentile75/10) / 100
+	ret.Percentile90 = math.Round(ret.Percentile90/10) / 100
+	return ret
+}
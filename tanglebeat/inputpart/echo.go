@@ -2,6 +2,7 @@ package inputpart
 
 import (
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
 	"time"
 )
@@ -28,6 +29,9 @@ var (
 func startEchoLatencyRoutine() {
 	echoBuffer = hashcache.NewHashCacheBase(
 		"echoBuffer", echoBufferHashLen, echoBufferSegmentDurationSec, echoBufferRetentionPeriodSec)
+	if cfg.Config.Histograms.LegacyGaugesDisabled {
+		return // averages are only needed for legacy gauges
+	}
 	go func() {
 		debugf("Started echo latency calculation routine")
 		var echoParams avgEchoParams
@@ -57,12 +61,13 @@ func checkForEcho(txhash string, ts uint64) {
 	echoBuffer.Lock()
 	defer echoBuffer.Unlock()
 
-	if echoBuffer.FindNolock(echoBuffer.ShortHash(txhash), &entry, true) {
+	if echoBuffer.FindNolock(echoBuffer.HashKey(txhash), &entry, true) {
 		d := entry.Data.(*echoEntry)
 		if 1 <= entry.Visits && entry.Visits <= whenSeenArrayLen {
 			d.whenSeenNth[entry.Visits-1] = ts
 			d.whenSeenLast = ts
 			d.seen = true
+			observeEchoLatency(int(entry.Visits), nonNegativeDuration(d.whenSent, ts))
 		}
 		debugf("+++++++ Promo tx echo nr = %v in %v msec. %v..", entry.Visits, ts-d.whenSent, txhash[:12])
 	}
@@ -0,0 +1,257 @@
+package inputpart
+
+import (
+	"context"
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"time"
+)
+
+// Input health policy periodically checks stats of running inputs and decides what to do with unhealthy ones:
+// close the output valve (messages from the input are not put into the cache), put the input on hold for some time
+// or drop it from the list of inputs.
+// Default policy consists of rules configured in the 'inputHealthPolicy' section of the config file
+
+const (
+	healthActionOpenValve  = "openValve"
+	healthActionCloseValve = "closeValve"
+	healthActionHold       = "hold"
+	healthActionDrop       = "drop"
+)
+
+type HealthDecision struct {
+	Uri     string
+	Action  string
+	HoldFor time.Duration // for 'hold' action
+	Reason  string
+}
+
+type InputHealthPolicy interface {
+	// returns decisions for inputs which state must be changed. Inputs not mentioned are left as they are
+	Evaluate(stats []*ZmqRoutineStats) []*HealthDecision
+}
+
+var inputHealthPolicy InputHealthPolicy = &ruleBasedHealthPolicy{}
+
+// replaces default rule based policy
+func SetInputHealthPolicy(policy InputHealthPolicy) {
+	inputHealthPolicy = policy
+}
+
+// values common for all inputs the rules may need
+type healthEnv struct {
+	avgTps  float64 // average tps of inputs with ctps > 0
+	lastLmi int
+}
+
+// returns reason if the input violates the rule, empty string otherwise
+type healthRuleFun func(st *ZmqRoutineStats, env *healthEnv, threshold float64) string
+
+var healthRules = map[string]healthRuleFun{
+	"tpsWithoutCtps": ruleTpsWithoutCtps,
+	"staleHeartbeat": ruleStaleHeartbeat,
+	"noSn":           ruleNoSn,
+	"seenOnceRate":   ruleSeenOnceRate,
+	"lmiLag":         ruleLmiLag,
+}
+
+func ruleTpsWithoutCtps(st *ZmqRoutineStats, env *healthEnv, threshold float64) string {
+	if env.avgTps == 0 || st.Ctps != 0 || st.Tps <= threshold*env.avgTps {
+		return ""
+	}
+	return fmt.Sprintf("ctps = 0 and tps %v > %v x avg tps %v", st.Tps, threshold, env.avgTps)
+}
+
+func ruleStaleHeartbeat(st *ZmqRoutineStats, env *healthEnv, threshold float64) string {
+	sec := utils.SinceUnixMs(st.LastHeartbeatTs) / 1000
+	if float64(sec) < threshold {
+		return ""
+	}
+	return fmt.Sprintf("no messages for %v sec", sec)
+}
+
+func ruleNoSn(st *ZmqRoutineStats, env *healthEnv, threshold float64) string {
+	msecAgo := st.LastSNMsecAgo
+	if msecAgo == 0 {
+		msecAgo = utils.SinceUnixMs(st.RunningSinceTs)
+	}
+	if float64(msecAgo) < threshold*60*1000 {
+		return ""
+	}
+	return fmt.Sprintf("no sn messages for %v min", msecAgo/60000)
+}
+
+func ruleSeenOnceRate(st *ZmqRoutineStats, env *healthEnv, threshold float64) string {
+	if float64(st.SeenOnceRate) <= threshold {
+		return ""
+	}
+	return fmt.Sprintf("seen once rate %v%% > %v%%", st.SeenOnceRate, threshold)
+}
+
+func ruleLmiLag(st *ZmqRoutineStats, env *healthEnv, threshold float64) string {
+	if env.lastLmi == 0 || float64(env.lastLmi-st.LastLmi) < threshold {
+		return ""
+	}
+	return fmt.Sprintf("last milestone index %v is behind %v", st.LastLmi, env.lastLmi)
+}
+
+type ruleBasedHealthPolicy struct{}
+
+func getInputHealthPolicyParams() (int, int, []cfg.InputHealthRule) {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	rules := make([]cfg.InputHealthRule, len(cfg.Config.InputHealthPolicy.Rules))
+	copy(rules, cfg.Config.InputHealthPolicy.Rules)
+	return cfg.Config.InputHealthPolicy.StartAfterSec, cfg.Config.InputHealthPolicy.MinRunningInputs, rules
+}
+
+func getInputHealthCheckPeriod() time.Duration {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return time.Duration(cfg.Config.InputHealthPolicy.CheckEverySec) * time.Second
+}
+
+// rules are checked in the order of configuration.
+// Valve is closed if any 'closeValve' rule is violated, otherwise it is open.
+// First violated 'hold' or 'drop' rule stops the input, unless there are too few inputs running
+func (p *ruleBasedHealthPolicy) Evaluate(stats []*ZmqRoutineStats) []*HealthDecision {
+	startAfterSec, minRunning, rules := getInputHealthPolicyParams()
+
+	env := &healthEnv{}
+	var num float64
+	var numRunning int
+	for _, st := range stats {
+		if st.Ctps > 0 {
+			env.avgTps += st.Tps
+			num++
+		}
+		if st.Running {
+			numRunning++
+		}
+	}
+	if num > 0 {
+		env.avgTps = env.avgTps / num
+	}
+	env.lastLmi, _ = getLmiStats()
+
+	ret := make([]*HealthDecision, 0)
+	for _, st := range stats {
+		if !st.Running || utils.SinceUnixMs(st.RunningSinceTs) < uint64(startAfterSec)*1000 {
+			continue
+		}
+		var valve *HealthDecision
+		var stop *HealthDecision
+		for _, rule := range rules {
+			fun, ok := healthRules[rule.Rule]
+			if !ok {
+				continue
+			}
+			reason := fun(st, env, rule.Threshold)
+			if reason == "" {
+				continue
+			}
+			reason = rule.Rule + ": " + reason
+			switch rule.Action {
+			case healthActionCloseValve:
+				if valve == nil {
+					valve = &HealthDecision{Uri: st.Uri, Action: healthActionCloseValve, Reason: reason}
+				}
+			case healthActionHold, healthActionDrop:
+				if stop == nil && numRunning > minRunning {
+					stop = &HealthDecision{
+						Uri:     st.Uri,
+						Action:  rule.Action,
+						HoldFor: time.Duration(rule.HoldMin) * time.Minute,
+						Reason:  reason,
+					}
+				}
+			}
+		}
+		switch {
+		case stop != nil:
+			ret = append(ret, stop)
+			numRunning--
+		case valve != nil:
+			ret = append(ret, valve)
+		case st.OutputClosed:
+			ret = append(ret, &HealthDecision{Uri: st.Uri, Action: healthActionOpenValve, Reason: "healthy"})
+		}
+	}
+	return ret
+}
+
+func checkInputHealthRules() {
+	_, _, rules := getInputHealthPolicyParams()
+	for _, rule := range rules {
+		if _, ok := healthRules[rule.Rule]; !ok {
+			warningf("Input health policy: unknown rule '%v' will be ignored", rule.Rule)
+		}
+		switch rule.Action {
+		case healthActionCloseValve, healthActionHold, healthActionDrop:
+		default:
+			warningf("Input health policy: unknown action '%v' of the rule '%v' will be ignored", rule.Action, rule.Rule)
+		}
+	}
+}
+
+func startInputHealthPolicyRoutine(ctx context.Context) {
+	checkInputHealthRules()
+	go inputHealthPolicyLoop(ctx)
+	infof("Started 'inputHealthPolicyLoop'")
+}
+
+// the period is read on each iteration because it can be changed by reloading the config
+func inputHealthPolicyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(getInputHealthCheckPeriod()):
+		case <-ctx.Done():
+			infof("Stopped 'inputHealthPolicyLoop'")
+			return
+		}
+
+		stats := GetInputStats()
+		if len(stats) == 0 {
+			continue
+		}
+		updateInputWeights(stats)
+		for _, d := range inputHealthPolicy.Evaluate(stats) {
+			applyHealthDecision(d)
+		}
+		var numOpen, numClosed int
+		for _, st := range stats {
+			if !st.Running {
+				continue
+			}
+			if st.routine.IsOutputClosed() {
+				numClosed++
+			} else {
+				numOpen++
+			}
+		}
+		infof("Output valve: open %v, closed %v", numOpen, numClosed)
+	}
+}
+
+func applyHealthDecision(d *HealthDecision) {
+	infof("Input health policy: %v '%v'. Reason: %v", d.Action, d.Uri, d.Reason)
+	switch d.Action {
+	case healthActionOpenValve, healthActionCloseValve:
+		ir, ok := inputRoutines.GetInputReader(d.Uri)
+		if !ok {
+			return
+		}
+		ir.(*inputRoutine).setValve(d.Action == healthActionCloseValve, d.Reason)
+	case healthActionHold:
+		reason := inreaders.ReasonNotRunning(fmt.Sprintf("onHold%vmin (%v)", int(d.HoldFor.Minutes()), d.Reason))
+		inputRoutines.PutInputReaderOnHold(d.Uri, d.HoldFor, reason)
+	case healthActionDrop:
+		if err := RemoveInput(d.Uri); err != nil {
+			errorf("Input health policy: %v", err)
+		}
+	default:
+		errorf("Input health policy: unknown action '%v'", d.Action)
+	}
+}
@@ -0,0 +1,157 @@
+package inputpart
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// adding, removing, enabling and disabling input streams while hub is running
+
+func AddInput(uri string, protocol string) error {
+	var inputStreamType int
+	switch protocol {
+	case "zmq", "":
+		inputStreamType = inputStreamZMQ
+	case "nanomsg":
+		inputStreamType = inputStreamNanomsg
+	default:
+		return fmt.Errorf("wrong protocol '%v'. Expected 'zmq' or 'nanomsg'", protocol)
+	}
+	if err := createInputRoutine(uri, inputStreamType); err != nil {
+		return err
+	}
+	infof("Added input %v (%v)", uri, protocol)
+	CheckQuorums()
+	return nil
+}
+
+func RemoveInput(uri string) error {
+	if !inputRoutines.RemoveInputReader(uri) {
+		return fmt.Errorf("input '%v' not found", uri)
+	}
+	deleteInputMetrics(uri)
+	infof("Removed input %v", uri)
+	CheckQuorums()
+	return nil
+}
+
+func EnableInput(uri string, enable bool) error {
+	if !inputRoutines.SetInputReaderEnabled(uri, enable) {
+		return fmt.Errorf("input '%v' not found", uri)
+	}
+	infof("Input %v enabled = %v", uri, enable)
+	CheckQuorums()
+	return nil
+}
+
+// uris of inputs by protocol, sorted
+func InputUris() ([]string, []string) {
+	zmq := make([]string, 0)
+	nanomsg := make([]string, 0)
+	inputRoutines.ForEach(func(name string, ir inreaders.InputReader) {
+		switch ir.(*inputRoutine).inputStreamType {
+		case inputStreamZMQ:
+			zmq = append(zmq, name)
+		case inputStreamNanomsg:
+			nanomsg = append(nanomsg, name)
+		}
+	})
+	sort.Strings(zmq)
+	sort.Strings(nanomsg)
+	return zmq, nanomsg
+}
+
+type inputsAPIResponse struct {
+	Result string             `json:"result"`
+	Error  string             `json:"error,omitempty"`
+	Inputs []*ZmqRoutineStats `json:"inputs,omitempty"`
+}
+
+func writeInputsAPIResponse(w http.ResponseWriter, status int, resp *inputsAPIResponse) {
+	data, err := json.MarshalIndent(resp, "", "   ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error while marshaling response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// GET  /api1/inputs                           list of inputs with stats
+// POST /api1/inputs/add?uri=<uri>&protocol=<zmq|nanomsg>
+// POST /api1/inputs/remove?uri=<uri>
+// POST /api1/inputs/enable?uri=<uri>
+// POST /api1/inputs/disable?uri=<uri>
+
+func HandlerInputs(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api1/inputs"), "/")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			writeInputsAPIResponse(w, http.StatusMethodNotAllowed, &inputsAPIResponse{
+				Result: "error",
+				Error:  "expected GET",
+			})
+			return
+		}
+		writeInputsAPIResponse(w, http.StatusOK, &inputsAPIResponse{
+			Result: "ok",
+			Inputs: GetInputStats(),
+		})
+		return
+	}
+	if !cfg.Config.InputsAPIEnabled {
+		writeInputsAPIResponse(w, http.StatusForbidden, &inputsAPIResponse{
+			Result: "error",
+			Error:  "changing inputs is disabled by 'inputsApiEnabled' config parameter",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeInputsAPIResponse(w, http.StatusMethodNotAllowed, &inputsAPIResponse{
+			Result: "error",
+			Error:  "expected POST",
+		})
+		return
+	}
+	uri := r.FormValue("uri")
+	if uri == "" {
+		writeInputsAPIResponse(w, http.StatusBadRequest, &inputsAPIResponse{
+			Result: "error",
+			Error:  "parameter 'uri' is missing",
+		})
+		return
+	}
+	debugf("Inputs API request '%v' for %v from %v", action, uri, r.RemoteAddr)
+
+	var err error
+	switch action {
+	case "add":
+		err = AddInput(uri, r.FormValue("protocol"))
+	case "remove":
+		err = RemoveInput(uri)
+	case "enable":
+		err = EnableInput(uri, true)
+	case "disable":
+		err = EnableInput(uri, false)
+	default:
+		writeInputsAPIResponse(w, http.StatusNotFound, &inputsAPIResponse{
+			Result: "error",
+			Error:  fmt.Sprintf("unknown action '%v'", action),
+		})
+		return
+	}
+	if err != nil {
+		writeInputsAPIResponse(w, http.StatusBadRequest, &inputsAPIResponse{
+			Result: "error",
+			Error:  err.Error(),
+		})
+		return
+	}
+	writeInputsAPIResponse(w, http.StatusOK, &inputsAPIResponse{Result: "ok"})
+}
@@ -8,6 +8,8 @@ import (
 	"nanomsg.org/go-mangos/protocol/sub"
 	"nanomsg.org/go-mangos/transport/tcp"
 	"strings"
+	"sync"
+	"time"
 )
 
 type inSocket interface {
@@ -15,14 +17,21 @@ type inSocket interface {
 	Close()
 }
 
+// Close may be called more than once: by the stopping routine and upon leaving Run.
+// Subsequent calls wait until the first one is finished
+
+const socketCloseTimeout = 5 * time.Second
+
 type zmqInSocket struct {
-	uri    string
-	socket zmq4.Socket
+	uri       string
+	socket    zmq4.Socket
+	closeOnce sync.Once
 }
 
 type nanomsgInSocket struct {
-	uri    string
-	socket mangos.Socket
+	uri       string
+	socket    mangos.Socket
+	closeOnce sync.Once
 }
 
 func NewZmqSocket(uri string, topics []string) (inSocket, error) {
@@ -65,10 +74,9 @@ func (s *zmqInSocket) RecvMsg() ([]byte, []string, error) {
 }
 
 func (s *zmqInSocket) Close() {
-	// better leak go routine than block or leak socket
-	go func() {
-		_ = s.socket.Close()
-	}()
+	s.closeOnce.Do(func() {
+		closeWithTimeout(s.uri, s.socket.Close)
+	})
 }
 
 func (s *nanomsgInSocket) RecvMsg() ([]byte, []string, error) {
@@ -85,8 +93,21 @@ func (s *nanomsgInSocket) RecvMsg() ([]byte, []string, error) {
 }
 
 func (s *nanomsgInSocket) Close() {
-	// better leak go routine than block or leak socket
+	s.closeOnce.Do(func() {
+		closeWithTimeout(s.uri, s.socket.Close)
+	})
+}
+
+// closing may block. It waits limited time and then leaves closing in the background
+func closeWithTimeout(uri string, closeFun func() error) {
+	done := make(chan struct{})
 	go func() {
-		_ = s.socket.Close()
+		_ = closeFun()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(socketCloseTimeout):
+		errorf("Closing socket of %v takes longer than %v. Left closing in the background", uri, socketCloseTimeout)
+	}
 }
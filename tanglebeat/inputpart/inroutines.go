@@ -1,12 +1,17 @@
 package inputpart
 
 import (
+	"context"
 	"fmt"
 	"github.com/unioproject/tanglebeat/lib/ebuffer"
-	"github.com/unioproject/tanglebeat/lib/nanomsg"
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
 	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"github.com/unioproject/tanglebeat/tanglebeat/outsink"
 	"math"
+	"net/url"
 	"sort"
 	"time"
 )
@@ -32,52 +37,114 @@ type inputRoutine struct {
 	lmiCount               int
 	lastLmi                int
 	obsoleteSnCount        uint64
+	filterDrops            uint64 // messages dropped because the filter queue was full
+	parseErrors            uint64 // invalid messages
 	lastSeenOnceRate       uint64
 	lastSeenSomeMinSNCount uint64
 	tsLastTXSomeMin        *ebuffer.EventTsExpiringBuffer
 	tsLastSNSomeMin        *ebuffer.EventTsExpiringBuffer
+	lastTXTs               uint64
+	lastSNTs               uint64
+	tsLeaderTXSomeMin      *ebuffer.EventTsExpiringBuffer        // when the input was first to deliver tx
+	tsLeaderSNSomeMin      *ebuffer.EventTsExpiringBuffer        // when the input was first to deliver sn
+	behindTXSomeMin        *ebuffer.EventTsWithIntExpiringBuffer // msec behind the first source, 0 if first
+	behindSNSomeMin        *ebuffer.EventTsWithIntExpiringBuffer
+	weight                 float32 // weight of the vote of the input in the weighted quorum
+	valveReason            string  // why the output valve was closed by the health policy
 }
 
-func createInputRoutine(uri string, inputStreamType int) {
+// same check for inputs from the config file and inputs added while running
+func checkInputUri(uri string) error {
+	p, err := url.Parse(uri)
+	if err == nil {
+		switch p.Scheme {
+		case "tcp":
+			if p.Hostname() != "" && p.Port() != "" {
+				return nil
+			}
+		case "ipc", "inproc":
+			if p.Host != "" || p.Path != "" || p.Opaque != "" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("wrong input uri '%v'. Expected 'tcp://<host>:<port>', 'ipc://<path>' or 'inproc://<name>'", uri)
+}
+
+func createInputRoutine(uri string, inputStreamType int) error {
+	if err := checkInputUri(uri); err != nil {
+		return err
+	}
+	weight, _ := getConfiguredWeight(uri)
 	ret := &inputRoutine{
 		InputReaderBase: *inreaders.NewInputReaderBase(),
 		inputStreamType: inputStreamType,
 		uri:             uri,
+		weight:          float32(weight),
 	}
-	inputRoutines.AddInputReader(uri, ret)
+	return inputRoutines.AddInputReader(uri, ret)
 }
 
 var (
-	inputRoutines        *inreaders.InputReaderSet
-	compoundOutPublisher *nanomsg.Publisher
+	inputRoutines *inreaders.InputReaderSet
+	compoundOut   *outsink.SinkSet
 )
 
-func MustInitInputRoutines(outEnabled bool, outPort int, inputsZMQ []string, inputsNanomsg []string) {
+// When the context is cancelled, input routines are stopped, messages left in the filter queue are processed
+// and then outputs are stopped. Extra outputs (the feed) receive the same stream
+func MustInitInputRoutines(ctx context.Context, outputs []cfg.OutputSinkParams, inputsZMQ []string, inputsNanomsg []string, extra ...outsink.Sink) {
 	initZmqMetrics()
-	initMsgFilter()
+	inputRoutines = inreaders.NewInputReaderSet(ctx, "inreader set")
+	inputRoutines.SetRestartCallback(updateInputRestartsCounter)
+	inputRoutines.SetBackoffParams(
+		time.Duration(cfg.Config.InputRestart.BaseSec)*time.Second,
+		time.Duration(cfg.Config.InputRestart.MaxSec)*time.Second,
+		time.Duration(cfg.Config.InputRestart.ResetAfterSec)*time.Second,
+		cfg.Config.InputRestart.Jitter)
+	initMsgFilter(ctx)
+	initTransferStream(ctx)
 	initValueTx()
-
-	inputRoutines = inreaders.NewInputReaderSet("inreader set")
+	startEchoLatencyRoutine()
+	initCacheSnapshots(ctx)
+
+	// outputs are stopped only after the filter is drained
+	ctxOutputs, cancelOutputs := context.WithCancel(context.Background())
+	go func() {
+		<-filterDone
+		cancelOutputs()
+	}()
 	var err error
-	compoundOutPublisher, err = nanomsg.NewPublisher(outEnabled, outPort, 0, localLog)
+	compoundOut, err = outsink.NewSinkSet(ctxOutputs, outputs, extra...)
 	if err != nil {
-		errorf("Failed to create publishing channel. Publisher is disabled: %v", err)
+		errorf("Failed to create outputs of the compound stream: %v", err)
 		panic(err)
 	}
-	if outEnabled {
-		infof("Publisher for output stream initialized successfully on port %v", outPort)
-	} else {
-		infof("Publisher for output stream is DISABLED")
+	if len(outputs)+len(extra) == 0 {
+		infof("Output stream is DISABLED")
 	}
 
 	for _, uri := range inputsZMQ {
-		createInputRoutine(uri, inputStreamZMQ)
+		if err := createInputRoutine(uri, inputStreamZMQ); err != nil {
+			errorf("%v", err)
+		}
 	}
 	for _, uri := range inputsNanomsg {
-		createInputRoutine(uri, inputStreamNanomsg)
+		if err := createInputRoutine(uri, inputStreamNanomsg); err != nil {
+			errorf("%v", err)
+		}
 	}
-	startOutValveRoutine()
-	startEchoLatencyRoutine()
+	CheckQuorums()
+	checkInputTopics()
+	startInputHealthPolicyRoutine(ctx)
+}
+
+// waits until input routines, the filter and outputs are stopped after the context was cancelled
+// and caches are saved
+func Wait() {
+	inputRoutines.Wait()
+	<-filterDone
+	compoundOut.Wait()
+	<-snapshotDone
 }
 
 func (r *inputRoutine) GetUri() string {
@@ -86,33 +153,59 @@ func (r *inputRoutine) GetUri() string {
 	return r.uri
 }
 
-func (r *inputRoutine) checkOnHoldCondition() inreaders.ReasonNotRunning {
-	if inputRoutines.NumRunning() < 10 {
-		return inreaders.REASON_NORUN_NONE
+func (r *inputRoutine) setValve(closed bool, reason string) {
+	r.SetOutputClosed(closed)
+	r.Lock()
+	defer r.Unlock()
+	if closed {
+		r.valveReason = reason
+	} else {
+		r.valveReason = ""
 	}
+}
+
+func (r *inputRoutine) getWeight() float32 {
 	r.RLock()
 	defer r.RUnlock()
-	ret := inreaders.REASON_NORUN_NONE
-	// do not put on hold first 5 minutes of run and in case less than 10 readesr left
-	if time.Since(r.ReadingSince) > 5*time.Minute {
-		if r.lastSeenSomeMinSNCount == 0 {
-			// put on hold for 15 min if last 5 min no sn tx came
-			infof("Last 5 min no SN message came. Put on hold 15 min: %v", r.uri)
-			ret = inreaders.REASON_NORUN_ONHOLD_15MIN
+	return r.weight
+}
+
+// weight is taken from config (1 by default).
+// If 'auto' is enabled, it is decreased for slow or inactive inputs, inputs with high seen once rate
+// and inputs with confirmation rate lower than the compound one
+func (r *inputRoutine) updateWeight(stats *ZmqRoutineStats, compoundConfRate int) {
+	weight, auto := getConfiguredWeight(stats.Uri)
+	if auto {
+		switch stats.State {
+		case "running", "running (wait_milestone)":
+		case "slow":
+			weight *= 0.5
+		default:
+			weight = 0
+		}
+		if stats.SeenOnceRate < 100 {
+			weight *= float64(100-stats.SeenOnceRate) / 100
+		} else {
+			weight = 0
+		}
+		if compoundConfRate > 0 && stats.Tps > 0 && int(stats.Confrate) < compoundConfRate {
+			weight *= float64(stats.Confrate) / float64(compoundConfRate)
 		}
 	}
-	return ret
-}
+	stats.Weight = float32(math.Round(weight*100) / 100)
 
-var topics = []string{"tx", "sn", "lmi", "lmhs"}
+	r.Lock()
+	defer r.Unlock()
+	r.weight = stats.Weight
+}
 
-func expectedTopic(topic string) bool {
-	for _, t := range topics {
-		if t == topic {
-			return true
-		}
+// weights are updated periodically by the input health policy loop,
+// so they follow the stats and changes of the config
+func updateInputWeights(stats []*ZmqRoutineStats) {
+	_, compound10min := GetOutputStats()
+	for _, st := range stats {
+		st.routine.updateWeight(st, compound10min.ConfRate)
 	}
-	return false
 }
 
 func (r *inputRoutine) init() {
@@ -124,6 +217,14 @@ func (r *inputRoutine) init() {
 		"tsLastTXSomeMin: "+uri, tlTXCacheSegmentDurationSec, routineBufferRetentionMin*60)
 	r.tsLastSNSomeMin = ebuffer.NewEventTsExpiringBuffer(
 		"tsLastSNSomeMin: "+uri, tlSNCacheSegmentDurationSec, routineBufferRetentionMin*60)
+	r.tsLeaderTXSomeMin = ebuffer.NewEventTsExpiringBuffer(
+		"tsLeaderTXSomeMin: "+uri, tlTXCacheSegmentDurationSec, routineBufferRetentionMin*60)
+	r.tsLeaderSNSomeMin = ebuffer.NewEventTsExpiringBuffer(
+		"tsLeaderSNSomeMin: "+uri, tlSNCacheSegmentDurationSec, routineBufferRetentionMin*60)
+	r.behindTXSomeMin = ebuffer.NewEventTsWithIntExpiringBuffer(
+		"behindTXSomeMin: "+uri, tlTXCacheSegmentDurationSec, routineBufferRetentionMin*60)
+	r.behindSNSomeMin = ebuffer.NewEventTsWithIntExpiringBuffer(
+		"behindSNSomeMin: "+uri, tlSNCacheSegmentDurationSec, routineBufferRetentionMin*60)
 	r.initialized = true
 }
 
@@ -136,10 +237,13 @@ func (r *inputRoutine) uninit() {
 	r.obsoleteSnCount = 0
 	r.tsLastTXSomeMin = nil
 	r.tsLastSNSomeMin = nil
+	r.tsLeaderTXSomeMin = nil
+	r.tsLeaderSNSomeMin = nil
+	r.behindTXSomeMin = nil
+	r.behindSNSomeMin = nil
 	r.initialized = false
 }
 
-// TODO dynamically / upon user action add, delete, disable, enable input streams
 // TODO nanomsg routines, inputRoutine code reuse
 
 func (r *inputRoutine) Run(name string) inreaders.ReasonNotRunning {
@@ -150,6 +254,13 @@ func (r *inputRoutine) Run(name string) inreaders.ReasonNotRunning {
 	var socket inSocket
 	var err error
 
+	// subscription is by prefix (e.g. 'tx' also subscribes to 'tx_trytes'), so topics are checked exactly
+	topics := getInputTopics(uri)
+	expected := make(map[string]bool)
+	for _, t := range topics {
+		expected[t] = knownTopic(t)
+	}
+	txTrytes := isTxTrytesInput(uri)
 	switch r.inputStreamType {
 	case inputStreamZMQ:
 		socket, err = NewZmqSocket(uri, topics)
@@ -166,6 +277,18 @@ func (r *inputRoutine) Run(name string) inreaders.ReasonNotRunning {
 	}
 	defer socket.Close()
 
+	// closing the socket is the only way to interrupt blocking RecvMsg
+	chStop := r.GetStopChan()
+	chDone := make(chan struct{})
+	defer close(chDone)
+	go func() {
+		select {
+		case <-chStop:
+			socket.Close()
+		case <-chDone:
+		}
+	}()
+
 	r.SetReading(true)
 
 	infof("Successfully started input routine for %v", uri)
@@ -173,16 +296,35 @@ func (r *inputRoutine) Run(name string) inreaders.ReasonNotRunning {
 		msg, msgSplit, err := socket.RecvMsg()
 
 		if err != nil {
+			if r.IsStopRequested() {
+				infof("Input routine for %v was stopped", uri)
+				return inreaders.REASON_NORUN_DISABLED
+			}
 			errorf("%v", err)
 			r.SetLastErr(fmt.Sprintf("%v", err))
 			return inreaders.REASON_NORUN_ERROR
 		}
 		r.SetLastHeartbeatNow()
 
-		// send to filter's channel
-		if expectedTopic(msgSplit[0]) {
-			toFilter(r, msg, msgSplit)
+		topic := msgSplit[0]
+		switch {
+		case txTrytes && topic == "tx_trytes":
+			// tx message is synthesized from verified trytes
+			msg, msgSplit, err = synthesizeTxMsg(msgSplit)
+		case !expected[topic]:
+			continue
+		}
+		var parsed interface{}
+		if err == nil {
+			parsed, err = zmqmsg.Parse(msgSplit)
 		}
+		if err != nil {
+			updateParseErrorsCounter(r, topic)
+			errorf("%v: invalid '%v' message: %v", uri, topic, err)
+			continue
+		}
+		// send to filter's channel
+		toFilter(r, msg, msgSplit, parsed)
 	}
 }
 
@@ -193,6 +335,7 @@ func (r *inputRoutine) accountTx() {
 		return
 	}
 	r.txCount++
+	r.lastTXTs = utils.UnixMsNow()
 	r.tsLastTXSomeMin.RecordTS()
 }
 
@@ -203,9 +346,62 @@ func (r *inputRoutine) accountSn() {
 		return
 	}
 	r.ctxCount++
+	r.lastSNTs = utils.UnixMsNow()
 	r.tsLastSNSomeMin.RecordTS()
 }
 
+// records if the input was the first to deliver the tx message or how much it was behind the first one
+func (r *inputRoutine) accountTxPropagation(entry *hashcache.CacheEntry) {
+	r.Lock()
+	defer r.Unlock()
+	if !r.initialized {
+		return
+	}
+	accountPropagation(entry, r.tsLeaderTXSomeMin, r.behindTXSomeMin)
+}
+
+func (r *inputRoutine) accountSnPropagation(entry *hashcache.CacheEntry) {
+	r.Lock()
+	defer r.Unlock()
+	if !r.initialized {
+		return
+	}
+	accountPropagation(entry, r.tsLeaderSNSomeMin, r.behindSNSomeMin)
+}
+
+func accountPropagation(entry *hashcache.CacheEntry, leader *ebuffer.EventTsExpiringBuffer, behind *ebuffer.EventTsWithIntExpiringBuffer) {
+	if entry.Visits == 1 {
+		leader.RecordTS()
+		behind.RecordInt(0)
+		return
+	}
+	behind.RecordInt(int(entry.LastSeen - entry.FirstSeen))
+}
+
+// returns percentage of messages the input delivered first and average delay behind the first source in seconds
+func propagationStats(leader *ebuffer.EventTsExpiringBuffer, behind *ebuffer.EventTsWithIntExpiringBuffer) (uint64, float64) {
+	var num, sumMsec int
+	behind.ForEachEntry(func(ts uint64, msec int) bool {
+		num++
+		sumMsec += msec
+		return true
+	}, utils.UnixMsNow()-routineBufferRetentionMin*60*1000, true)
+	if num == 0 {
+		return 0, 0
+	}
+	numLeader, _ := leader.CountAll()
+	leaderPerc := uint64(numLeader * 100 / num)
+	avgBehindSec := math.Round(float64(sumMsec)/float64(num)/10) / 100
+	return leaderPerc, avgBehindSec
+}
+
+func msecAgo(ts uint64) uint64 {
+	if ts == 0 {
+		return 0
+	}
+	return utils.SinceUnixMs(ts)
+}
+
 func (r *inputRoutine) accountLmi(index int) {
 	r.Lock()
 	defer r.Unlock()
@@ -225,6 +421,18 @@ func (r *inputRoutine) incObsoleteCount() {
 	r.obsoleteSnCount++
 }
 
+func (r *inputRoutine) incFilterDrops() {
+	r.Lock()
+	defer r.Unlock()
+	r.filterDrops++
+}
+
+func (r *inputRoutine) incParseErrors() {
+	r.Lock()
+	defer r.Unlock()
+	r.parseErrors++
+}
+
 type ZmqRoutineStats struct {
 	Uri      string `json:"uri"`
 	Id       uint64 `json:"id"`
@@ -237,6 +445,8 @@ type ZmqRoutineStats struct {
 	CtxCountSomeMin      uint64 `json:"ctxCountSomeMin"`
 	timeIntervalSec10min uint64
 	ObsoleteConfirmCount uint64  `json:"obsoleteSNCount"`
+	FilterDrops          uint64  `json:"filterDrops"`
+	ParseErrors          uint64  `json:"parseErrors"`
 	Tps                  float64 `json:"tps"`
 	Ctps                 float64 `json:"ctps"`
 	Confrate             uint64  `json:"confrate"`
@@ -244,6 +454,13 @@ type ZmqRoutineStats struct {
 	LastLmi              int     `json:"lastLmi"`
 	SeenOnceRate         uint64  `json:"seenOnceRate"`
 	State                string  `json:"state"`
+	Weight               float32 `json:"weight"`
+	LeaderTXPerc         uint64  `json:"leaderTXPerc"`
+	LeaderSNPerc         uint64  `json:"leaderSNPerc"`
+	AvgBehindTXSec       float64 `json:"avgBehindTXSec"`
+	AvgBehindSNSec       float64 `json:"avgBehindSNSec"`
+	LastTXMsecAgo        uint64  `json:"lastTXMsecAgo"`
+	LastSNMsecAgo        uint64  `json:"lastSNMsecAgo"`
 	routine              *inputRoutine
 }
 
@@ -294,11 +511,19 @@ func (r *inputRoutine) getStats() *ZmqRoutineStats {
 		CtxCountSomeMin:      uint64(numLastSN5Min),
 		timeIntervalSec10min: timeIntervalSec,
 		ObsoleteConfirmCount: r.obsoleteSnCount,
+		FilterDrops:          r.filterDrops,
+		ParseErrors:          r.parseErrors,
 		Ctps:                 ctps,
 		Confrate:             confrate,
 		LmiCount:             r.lmiCount,
 		LastLmi:              r.lastLmi,
 		SeenOnceRate:         r.lastSeenOnceRate,
+		LastTXMsecAgo:        msecAgo(r.lastTXTs),
+		LastSNMsecAgo:        msecAgo(r.lastSNTs),
+	}
+	if r.initialized {
+		ret.LeaderTXPerc, ret.AvgBehindTXSec = propagationStats(r.tsLeaderTXSomeMin, r.behindTXSomeMin)
+		ret.LeaderSNPerc, ret.AvgBehindSNSec = propagationStats(r.tsLeaderSNSomeMin, r.behindSNSomeMin)
 	}
 	if ret.Running {
 		lastHBSec := utils.SinceUnixMs(ret.LastHeartbeatTs) / 1000
@@ -317,6 +542,11 @@ func (r *inputRoutine) getStats() *ZmqRoutineStats {
 	} else {
 		ret.State = string(r.GetOnHoldInfo__())
 	}
+	ret.Weight = r.weight
+	if ret.Running && ret.OutputClosed && r.valveReason != "" {
+		ret.State = fmt.Sprintf("%v (valve closed: %v)", ret.State, r.valveReason)
+	}
+	updateInputMetrics(ret)
 	ret.routine = r
 	return ret
 }
@@ -6,6 +6,7 @@ import (
 	. "github.com/prometheus/client_golang/prometheus"
 	"github.com/unioproject/tanglebeat/lib/utils"
 	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
 	"time"
 )
 
@@ -35,6 +36,25 @@ var (
 	//lmConfRate30minMetrics Gauge
 
 	multiQuorumTps *CounterVec
+
+	lateQuorumCounter *CounterVec
+
+	inputWeight       *GaugeVec
+	inputLeaderPerc   *GaugeVec
+	inputAvgBehindSec *GaugeVec
+	inputRestarts     *CounterVec
+
+	filterQueueDepth     Gauge
+	filterQueueCapacity  Gauge
+	filterDrops          *CounterVec
+	filterBlocked        *CounterVec
+	filterProcessingTime Histogram
+
+	inputParseErrors *CounterVec
+
+	valueBundleConfTime Histogram
+	quorumLatency       *HistogramVec
+	echoLatency         *HistogramVec
 )
 
 func initZmqMetrics() {
@@ -50,14 +70,27 @@ func initZmqMetrics() {
 	})
 	MustRegister(zmqMetricsTransferCounter)
 
+	valueBundleConfTime = NewHistogram(HistogramOpts{
+		Name:    "tanglebeat_value_bundle_confirmation_seconds",
+		Help:    "Time from the first transaction of the value bundle to its confirmation",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramValueBundleConfirmation],
+	})
+	MustRegister(valueBundleConfTime)
+
 	//---------------------------------------------- value tx end
 
 	//---------------------------------------------- latency begin
+	quorumLatency = NewHistogramVec(HistogramOpts{
+		Name:    "tanglebeat_quorum_latency_seconds",
+		Help:    "Time from the first arrival of the message until it reached quorum, labeled by topic",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramQuorum],
+	}, []string{"topic"})
+	MustRegister(quorumLatency)
+
 	zmqMetricsLatencyTXAvg = NewGauge(GaugeOpts{
 		Name: "tanglebeat_latency_tx_avg",
 		Help: "Average relative latency of transaction messages",
 	})
-	MustRegister(zmqMetricsLatencyTXAvg)
 
 	zmqMetricsNotPropagatedPercTX = NewGauge(GaugeOpts{
 		Name: "tanglebeat_not_propagated_tx_perc",
@@ -69,7 +102,6 @@ func initZmqMetrics() {
 		Name: "tanglebeat_latency_confirm_avg",
 		Help: "Average relative latency of confirmation messages",
 	})
-	MustRegister(zmqMetricsLatencySNAvg)
 
 	zmqMetricsNotPropagatedPercSN = NewGauge(GaugeOpts{
 		Name: "tanglebeat_not_propagated_confirm_perc",
@@ -97,17 +129,30 @@ func initZmqMetrics() {
 	MustRegister(metricsMiotaPriceUSD)
 	startCollectingMiotaPrice(nil)
 
+	echoLatency = NewHistogramVec(HistogramOpts{
+		Name:    "tanglebeat_echo_latency_seconds",
+		Help:    "Time from sending the promotion tx until its Nth echo, labeled by echo number",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramEcho],
+	}, []string{"echonr"})
+	MustRegister(echoLatency)
+
 	echoMetricsAvgLastSeen = NewGauge(GaugeOpts{
 		Name: "tanglebeat_echo_last",
 		Help: "Average msec last echo",
 	})
-	MustRegister(echoMetricsAvgLastSeen)
 
 	echoMetricsAvgNthSeen = NewGaugeVec(GaugeOpts{
 		Name: "tanglebeat_nth_latency",
 		Help: "Average latency of Nth echo",
 	}, []string{"echonr"})
-	MustRegister(echoMetricsAvgNthSeen)
+
+	// averaged gauges are replaced by histograms
+	if !cfg.Config.Histograms.LegacyGaugesDisabled {
+		MustRegister(zmqMetricsLatencyTXAvg)
+		MustRegister(zmqMetricsLatencySNAvg)
+		MustRegister(echoMetricsAvgLastSeen)
+		MustRegister(echoMetricsAvgNthSeen)
+	}
 
 	//--------------------------------------------------
 	// metrics by Luca Moser
@@ -137,6 +182,73 @@ func initZmqMetrics() {
 	//MustRegister(lmConfRate30minMetrics)
 	//
 
+	lateQuorumCounter = NewCounterVec(CounterOpts{
+		Name: "tanglebeat_late_quorum_counter",
+		Help: "Number of messages which reached quorum too late to be passed, labeled by topic",
+	}, []string{"topic"})
+	MustRegister(lateQuorumCounter)
+
+	inputWeight = NewGaugeVec(GaugeOpts{
+		Name: "tanglebeat_input_weight",
+		Help: "Current weight of the input in the weighted quorum, labeled by input uri",
+	}, []string{"uri"})
+	MustRegister(inputWeight)
+
+	inputLeaderPerc = NewGaugeVec(GaugeOpts{
+		Name: "tanglebeat_input_leader_perc",
+		Help: "Percentage of messages the input delivered first, labeled by input uri and topic",
+	}, []string{"uri", "topic"})
+	MustRegister(inputLeaderPerc)
+
+	inputAvgBehindSec = NewGaugeVec(GaugeOpts{
+		Name: "tanglebeat_input_avg_behind_sec",
+		Help: "Average delay in seconds behind the first source, labeled by input uri and topic",
+	}, []string{"uri", "topic"})
+	MustRegister(inputAvgBehindSec)
+
+	inputRestarts = NewCounterVec(CounterOpts{
+		Name: "tanglebeat_input_restarts_total",
+		Help: "Number of restarts of the input, labeled by input uri",
+	}, []string{"uri"})
+	MustRegister(inputRestarts)
+
+	filterQueueDepth = NewGauge(GaugeOpts{
+		Name: "tanglebeat_filter_queue_depth",
+		Help: "Number of messages waiting in the filter queue",
+	})
+	MustRegister(filterQueueDepth)
+
+	filterQueueCapacity = NewGauge(GaugeOpts{
+		Name: "tanglebeat_filter_queue_capacity",
+		Help: "Size of the filter queue",
+	})
+	MustRegister(filterQueueCapacity)
+
+	filterDrops = NewCounterVec(CounterOpts{
+		Name: "tanglebeat_filter_dropped_total",
+		Help: "Number of messages dropped because the filter queue was full, labeled by input uri",
+	}, []string{"uri"})
+	MustRegister(filterDrops)
+
+	filterBlocked = NewCounterVec(CounterOpts{
+		Name: "tanglebeat_filter_blocked_total",
+		Help: "Number of times the input had to wait because the filter queue was full, labeled by input uri",
+	}, []string{"uri"})
+	MustRegister(filterBlocked)
+
+	filterProcessingTime = NewHistogram(HistogramOpts{
+		Name:    "tanglebeat_filter_processing_seconds",
+		Help:    "Time of filtering of one message",
+		Buckets: ExponentialBuckets(0.00001, 4, 10),
+	})
+	MustRegister(filterProcessingTime)
+
+	inputParseErrors = NewCounterVec(CounterOpts{
+		Name: "tanglebeat_input_parse_errors_total",
+		Help: "Number of invalid messages, labeled by input uri and topic",
+	}, []string{"uri", "topic"})
+	MustRegister(inputParseErrors)
+
 	if cfg.Config.MultiQuorumMetricsEnabled {
 		multiQuorumTps = NewCounterVec(CounterOpts{
 			Name: "tanglebeat_multiquorum_tps",
@@ -154,6 +266,18 @@ func updateTransferCounter(numTransfers int) {
 	zmqMetricsTransferCounter.Add(float64(numTransfers))
 }
 
+func updateValueBundleConfTimeMetrics(msec uint64) {
+	valueBundleConfTime.Observe(float64(msec) / 1000)
+}
+
+func observeQuorumLatency(topic string, entry *hashcache.CacheEntry) {
+	quorumLatency.With(Labels{"topic": topic}).Observe(float64(entry.LastSeen-entry.FirstSeen) / 1000)
+}
+
+func observeEchoLatency(echoNr int, msec uint64) {
+	echoLatency.With(Labels{"echonr": fmt.Sprintf("%d", echoNr)}).Observe(float64(msec) / 1000)
+}
+
 func updateCompoundMetrics(msgtype string) {
 	switch msgtype {
 	case "tx":
@@ -169,6 +293,62 @@ func updateMultiQuorumTpsCounter(quorum int) {
 	}
 }
 
+func updateLateQuorumCounter(topic string) {
+	lateQuorumCounter.With(Labels{"topic": topic}).Inc()
+}
+
+func updateInputMetrics(st *ZmqRoutineStats) {
+	inputWeight.With(Labels{"uri": st.Uri}).Set(float64(st.Weight))
+	inputLeaderPerc.With(Labels{"uri": st.Uri, "topic": "tx"}).Set(float64(st.LeaderTXPerc))
+	inputLeaderPerc.With(Labels{"uri": st.Uri, "topic": "sn"}).Set(float64(st.LeaderSNPerc))
+	inputAvgBehindSec.With(Labels{"uri": st.Uri, "topic": "tx"}).Set(st.AvgBehindTXSec)
+	inputAvgBehindSec.With(Labels{"uri": st.Uri, "topic": "sn"}).Set(st.AvgBehindSNSec)
+}
+
+func updateInputRestartsCounter(uri string) {
+	inputRestarts.With(Labels{"uri": uri}).Inc()
+}
+
+func updateFilterDropsCounter(routine *inputRoutine) {
+	routine.incFilterDrops()
+	filterDrops.With(Labels{"uri": routine.GetUri()}).Inc()
+}
+
+func updateParseErrorsCounter(routine *inputRoutine, topic string) {
+	routine.incParseErrors()
+	inputParseErrors.With(Labels{"uri": routine.GetUri(), "topic": topic}).Inc()
+}
+
+func updateFilterBlockedCounter(routine *inputRoutine) {
+	filterBlocked.With(Labels{"uri": routine.GetUri()}).Inc()
+}
+
+func updateFilterQueueDepth(depth int) {
+	filterQueueDepth.Set(float64(depth))
+}
+
+func setFilterQueueCapacity(size int) {
+	filterQueueCapacity.Set(float64(size))
+}
+
+func observeFilterProcessing(d time.Duration) {
+	filterProcessingTime.Observe(d.Seconds())
+}
+
+func deleteInputMetrics(uri string) {
+	inputWeight.Delete(Labels{"uri": uri})
+	inputRestarts.Delete(Labels{"uri": uri})
+	filterDrops.Delete(Labels{"uri": uri})
+	filterBlocked.Delete(Labels{"uri": uri})
+	for _, topic := range []string{"tx", "sn"} {
+		inputLeaderPerc.Delete(Labels{"uri": uri, "topic": topic})
+		inputAvgBehindSec.Delete(Labels{"uri": uri, "topic": topic})
+	}
+	for _, topic := range append(getInputTopics(uri), "tx_trytes") {
+		inputParseErrors.Delete(Labels{"uri": uri, "topic": topic})
+	}
+}
+
 func updateEchoMetrics(echoParams *avgEchoParams) {
 	echoMetricsAvgLastSeen.Set(float64(echoParams.avgLastSeenLatencyMs))
 
@@ -208,11 +388,13 @@ func startCollectingLatencyMetrics() {
 
 			getLatencyStats10minForMetrics(&lm)
 
-			zmqMetricsLatencyTXAvg.Set(lm.txAvgLatencySec)
 			zmqMetricsNotPropagatedPercTX.Set(lm.txNotPropagatedPerc)
-
-			zmqMetricsLatencySNAvg.Set(lm.snAvgLatencySec)
 			zmqMetricsNotPropagatedPercSN.Set(lm.snNotPropagatedPerc)
+
+			if !cfg.Config.Histograms.LegacyGaugesDisabled {
+				zmqMetricsLatencyTXAvg.Set(lm.txAvgLatencySec)
+				zmqMetricsLatencySNAvg.Set(lm.snAvgLatencySec)
+			}
 		}
 	}()
 }
@@ -1,26 +1,29 @@
 package inputpart
 
 import (
-	"fmt"
+	"context"
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
 	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
 	"math"
-	"strconv"
 	"sync"
+	"time"
 )
 
 const (
 	useFirstHashTrytes   = 12 // first N positions of the hash will only be used in hash table. To (significantly) spare memory
 	segmentDurationTXSec = 60
 	segmentDurationSNSec = 1 * 60
+	txCacheShards        = 16 // tx cache is sharded to reduce contention between filter workers and reporting
 )
 
 var (
-	txcache          *hashcache.HashCacheBase
+	txcache          *hashcache.ShardedHashCache
 	sncache          *hashCacheSN
 	lastLMI          int
 	lastLMITimesSeen int
+	lastLMISources   hashcache.SourceSet
 	lastLMIFirstSeen uint64
 	lastLMILastSeen  uint64
 	lmiMutex         = &sync.RWMutex{}
@@ -29,112 +32,239 @@ var (
 
 type zmqMsg struct {
 	routine  *inputRoutine
-	msgData  []byte   // original data
-	msgSplit []string // same split to strings
+	msgData  []byte      // original data
+	msgSplit []string    // same split to strings
+	parsed   interface{} // typed message, nil for extra topics
 }
 
-const filterChanBufSize = 100
+const filterChanBufSize = 100 // size of queues of filter workers
 
-var toFilterChan = make(chan *zmqMsg, filterChanBufSize)
+var (
+	toFilterChan chan *zmqMsg          // size is configured, created in initMsgFilter
+	filterDone   = make(chan struct{}) // closed when filter loop is finished
+)
+
+func getFilterQueuePolicy() string {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.FilterQueue.Policy
+}
 
-func toFilter(routine *inputRoutine, msgData []byte, msgSplit []string) {
-	toFilterChan <- &zmqMsg{
+// puts message into the filter queue. If the queue is full, the configured policy is applied
+func toFilter(routine *inputRoutine, msgData []byte, msgSplit []string, parsed interface{}) {
+	msg := &zmqMsg{
 		routine:  routine,
 		msgData:  msgData,
 		msgSplit: msgSplit,
+		parsed:   parsed,
+	}
+	select {
+	case toFilterChan <- msg:
+		return
+	default:
+	}
+	switch getFilterQueuePolicy() {
+	case cfg.FilterQueueDropNewest:
+		updateFilterDropsCounter(routine)
+	case cfg.FilterQueueDropOldest:
+		for {
+			select {
+			case old := <-toFilterChan:
+				updateFilterDropsCounter(old.routine)
+			default:
+			}
+			select {
+			case toFilterChan <- msg:
+				return
+			default:
+			}
+		}
+	default:
+		updateFilterBlockedCounter(routine)
+		toFilterChan <- msg
 	}
 }
 
-func initMsgFilter() {
+// filters message and measures time it took
+func processMsg(msg *zmqMsg) {
+	start := time.Now()
+	filterMsg(msg.routine, msg.msgData, msg.msgSplit, msg.parsed)
+	observeFilterProcessing(time.Since(start))
+}
+
+func initMsgFilter(ctx context.Context) {
 	retentionPeriodSec := cfg.Config.RetentionPeriodMin * 60
+	toFilterChan = make(chan *zmqMsg, cfg.Config.FilterQueue.Size)
+	setFilterQueueCapacity(cfg.Config.FilterQueue.Size)
 
-	txcache = hashcache.NewHashCacheBase(
-		"txcache", useFirstHashTrytes, segmentDurationTXSec, retentionPeriodSec)
+	txcache = hashcache.NewShardedHashCache(
+		"txcache", txCacheShards, useFirstHashTrytes, segmentDurationTXSec, retentionPeriodSec)
 	sncache = newHashCacheSN(
 		useFirstHashTrytes, segmentDurationSNSec, retentionPeriodSec)
 	// use all trytes of milestone hash
 	lmhsCache = hashcache.NewHashCacheBase("lmhscache", 0, segmentDurationTXSec, retentionPeriodSec)
+	initTopicFilter(retentionPeriodSec)
 
 	startCollectingLatencyMetrics()
 
 	// LM metrics is not needed anymore
 	//startCollectingLMConfRate()
 
-	go msgFilterLoop()
+	go msgFilterLoop(ctx)
+}
+
+// tx and sn messages are filtered by parallel workers if configured. Messages are partitioned by the shard
+// of the tx hash, so all messages with the same hash are processed by the same worker in order of arrival.
+// sn goes to the worker of the tx it confirms, so the confirmation is never processed before the tx
+// which created the bundle data. Other messages are filtered by the loop itself
+type filterWorkers struct {
+	chans []chan *zmqMsg
+	wg    sync.WaitGroup
+}
+
+func startFilterWorkers(num int) *filterWorkers {
+	ret := &filterWorkers{}
+	if num <= 1 {
+		return ret
+	}
+	ret.chans = make([]chan *zmqMsg, num)
+	for i := range ret.chans {
+		ret.chans[i] = make(chan *zmqMsg, filterChanBufSize)
+		ret.wg.Add(1)
+		go func(ch chan *zmqMsg) {
+			defer ret.wg.Done()
+			for msg := range ch {
+				processMsg(msg)
+			}
+		}(ret.chans[i])
+	}
+	infof("Started %v filter workers for tx and sn messages", num)
+	return ret
+}
+
+func (fw *filterWorkers) filter(msg *zmqMsg) {
+	var hash string
+	switch m := msg.parsed.(type) {
+	case *zmqmsg.TxMsg:
+		hash = m.Hash
+	case *zmqmsg.SnMsg:
+		hash = m.TxHash
+	}
+	if len(fw.chans) == 0 || hash == "" {
+		processMsg(msg)
+		return
+	}
+	fw.chans[txcache.ShardOf(hash)%len(fw.chans)] <- msg
 }
 
-func msgFilterLoop() {
-	for msg := range toFilterChan {
-		filterMsg(msg.routine, msg.msgData, msg.msgSplit)
+func (fw *filterWorkers) stop() {
+	for _, ch := range fw.chans {
+		close(ch)
+	}
+	fw.wg.Wait()
+}
+
+// after the context is cancelled, the loop is processing messages until all input routines are stopped,
+// then processes what is left in the queue and exits
+func msgFilterLoop(ctx context.Context) {
+	defer close(filterDone)
+
+	workers := startFilterWorkers(cfg.Config.FilterWorkers)
+	defer workers.stop()
+
+	inputsStopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		inputRoutines.Wait()
+		close(inputsStopped)
+	}()
+	for {
+		select {
+		case msg := <-toFilterChan:
+			updateFilterQueueDepth(len(toFilterChan))
+			workers.filter(msg)
+		case <-inputsStopped:
+			for {
+				select {
+				case msg := <-toFilterChan:
+					workers.filter(msg)
+				default:
+					infof("Message filter stopped")
+					return
+				}
+			}
+		}
 	}
 }
 
 // only start processing tx and sn messages after first two lmi messages arrived
 // the reason is to avoid (filter out) obsolete sn rubbish
-func filterMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
-	switch msgSplit[0] {
-	case "tx":
-		filterTXMsg(routine, msgData, msgSplit)
+func filterMsg(routine *inputRoutine, msgData []byte, msgSplit []string, parsed interface{}) {
+	switch msg := parsed.(type) {
+	case *zmqmsg.TxMsg:
+		filterTXMsg(routine, msgData, msg)
 
 		// disabled checking during Coo shutdown
 		//if sncache.firstMilestoneArrived() {
-		//	filterTXMsg(routine, msgData, msgSplit)
+		//	filterTXMsg(routine, msgData, msg)
 		//}
-	case "sn":
+	case *zmqmsg.SnMsg:
 		if sncache.firstMilestoneArrived() {
-			filterSNMsg(routine, msgData, msgSplit)
+			filterSNMsg(routine, msgData, msg)
 		}
-	case "lmi":
-		filterLMIMsg(routine, msgData, msgSplit)
+	case *zmqmsg.LmiMsg:
+		filterLMIMsg(routine, msgData, msg)
+
+	case *zmqmsg.LmhsMsg:
+		filterLMHSMsg(routine, msgData, msg)
 
-	case "lmhs":
-		filterLMHSMsg(routine, msgData, msgSplit)
+	default:
+		if tf, ok := extraTopics[msgSplit[0]]; ok {
+			filterExtraTopicMsg(routine, msgData, msgSplit, tf)
+		}
 	}
 }
 
-func filterTXMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
+func filterTXMsg(routine *inputRoutine, msgData []byte, tx *zmqmsg.TxMsg) {
 	var entry hashcache.CacheEntry
 
-	if len(msgSplit) < 2 {
-		errorf("%v: Message %v is invalid", routine.GetUri(), string(msgData))
-		return
-	}
-
 	routine.accountTx()
 	if routine.IsOutputClosed() {
 		return // not putting into the cache
 	}
 
-	txcache.SeenHashBy(msgSplit[1], routine.GetId__(), nil, &entry)
+	weight := routine.getWeight()
+	txcache.SeenHashByWeighted(tx.Hash, routine.GetId__(), weight, nil, &entry)
+	if entry.Repeated {
+		return // same source again, it does not count
+	}
+	routine.accountTxPropagation(&entry)
 
 	// check and account for echo to the promotion transactions
-	checkForEcho(msgSplit[1], utils.UnixMsNow())
-
-	// check if message was seen exactly number of times as configured (usually 2)
-	if int(entry.Visits) == GetTxQuorum() {
-		toOutput(msgData, msgSplit)
+	checkForEcho(tx.Hash, utils.UnixMsNow())
+
+	// check if message was seen exactly number of times as configured (usually 2) or reached weight threshold
+	// and, if configured, within time interval
+	if txQuorumReached(&entry) {
+		if withinQuorumInterval(&entry, getTxQuorumInterval()) {
+			toOutput(msgData, "tx")
+			observeQuorumLatency("tx", &entry)
+			processValueTx(tx)
+		} else {
+			updateLateQuorumCounter("tx")
+		}
 	}
 	// update multiquorum tps metrics for quorums 1, 2, 3, 4, 5
 	if 1 <= int(entry.Visits) && int(entry.Visits) <= 5 {
 		updateMultiQuorumTpsCounter(int(entry.Visits))
 	}
-	publishQuorumUpdate(msgSplit[1], int(entry.Visits))
+	publishQuorumUpdate(tx.Hash, int(entry.Visits))
 }
 
-func filterSNMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
-	var hash string
-	var err error
+func filterSNMsg(routine *inputRoutine, msgData []byte, sn *zmqmsg.SnMsg) {
 	var entry hashcache.CacheEntry
 
-	if len(msgSplit) < 3 {
-		errorf("%v: Message %v is invalid", routine.GetUri(), string(msgData))
-		return
-	}
-	obsolete, err := checkObsoleteMsg(msgData, msgSplit, routine.GetUri())
-	if err != nil {
-		errorf("checkObsoleteMsg: %v", err)
-		return
-	}
+	obsolete, _ := sncache.checkCurrentMilestoneIndex(sn.Index, routine.GetUri())
 	if obsolete {
 		// if index of the current confirmation message is less than the latest seen,
 		// confirmation is ignored.
@@ -147,34 +277,30 @@ func filterSNMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
 	if routine.IsOutputClosed() {
 		return // not putting into the cache
 	}
-	hash = msgSplit[2]
-
-	sncache.SeenHashBy(hash, routine.GetId__(), nil, &entry)
-
-	// check if message was seen exactly number of times as configured (usually 2)
-	if int(entry.Visits) == GetSnQuorum() {
-		toOutput(msgData, msgSplit)
-	}
-}
-
-func checkObsoleteMsg(msgData []byte, msgSplit []string, uri string) (bool, error) {
-	if len(msgSplit) < 3 {
-		return false, fmt.Errorf("%v: Message %v is invalid", uri, string(msgData))
+	weight := routine.getWeight()
+	sncache.SeenHashByWeighted(sn.TxHash, routine.GetId__(), weight, nil, &entry)
+	if entry.Repeated {
+		return
 	}
-	index, err := strconv.Atoi(msgSplit[1])
-	if err != nil {
-		return false, fmt.Errorf("expected index, found %v", msgSplit[1])
+	routine.accountSnPropagation(&entry)
+
+	// check if message was seen exactly number of times as configured or reached weight threshold
+	// and, if configured, within time interval
+	if snQuorumReached(&entry) {
+		if withinQuorumInterval(&entry, getSnQuorumInterval()) {
+			toOutput(msgData, "sn")
+			observeQuorumLatency("sn", &entry)
+			processConfirmation(sn)
+		} else {
+			updateLateQuorumCounter("sn")
+		}
 	}
-	obsolete, _ := sncache.checkCurrentMilestoneIndex(index, uri)
-	return obsolete, nil
 }
 
-func filterLMIMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
-	index, err := strconv.Atoi(msgSplit[1])
-	if err != nil {
-		errorf("Invalid 'lmi' message: at index 1 expected to be milestone index: %v", err)
-		return
-	}
+// index of the previous milestone is used, so sn messages of the milestone which is still
+// being solidified are not considered obsolete
+func filterLMIMsg(routine *inputRoutine, msgData []byte, lmi *zmqmsg.LmiMsg) {
+	index := lmi.PrevIndex
 	if !sncache.firstMilestoneArrived() {
 		uri := routine.GetUri()
 		infof("+++++++++++++++++ Milestone %v arrived from %v", index, uri)
@@ -191,40 +317,50 @@ func filterLMIMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
 	switch {
 	case index > lastLMI:
 		lastLMI = index
-		lastLMITimesSeen = 0
+		lastLMITimesSeen = 1
+		lastLMISources = hashcache.SourceSet{}
+		lastLMISources.Add(routine.GetId__())
 		lastLMIFirstSeen = utils.UnixMsNow()
 		lastLMILastSeen = utils.UnixMsNow()
 	case index == lastLMI:
+		if !lastLMISources.Add(routine.GetId__()) {
+			return // same source again
+		}
 		lastLMITimesSeen++
 		lastLMILastSeen = utils.UnixMsNow()
-		if lastLMITimesSeen == GetLmiQuorum() {
-			toOutput(msgData, msgSplit)
-		}
+	default:
+		return
+	}
+	// passed when seen exactly number of times as configured
+	if lastLMITimesSeen == GetLmiQuorum() {
+		toOutput(msgData, "lmi")
 	}
 }
 
 // TODO how to find out which lmhs message corresponds to the latest milestone
 
-func filterLMHSMsg(routine *inputRoutine, msgData []byte, msgSplit []string) {
-	if len(msgSplit) < 2 {
-		errorf("strange message %v", string(msgData))
-		return
-	}
+func filterLMHSMsg(routine *inputRoutine, msgData []byte, lmhs *zmqmsg.LmhsMsg) {
 	if routine.IsOutputClosed() {
 		return // not even checking against the cache
 	}
 	var entry hashcache.CacheEntry
 
-	lmhsCache.SeenHashBy(msgSplit[1], routine.GetId__(), nil, &entry)
+	lmhsCache.SeenHashBy(lmhs.Hash, routine.GetId__(), nil, &entry)
 	//infof("+++++ New lmhs '%v' #%v", string(msgData), entry.Visits)
+	if entry.Repeated {
+		return
+	}
 
 	// if msg is seen QuorumMilestoneHashToPass times during TimeIntervalMilestoneHashToPassMsec
 	// it is passed
-	if int(entry.Visits) == cfg.Config.QuorumMilestoneHashToPass {
-		interv := entry.LastSeen - entry.FirstSeen
-		if interv < cfg.Config.TimeIntervalMilestoneHashToPassMsec {
-			toOutput(msgData, msgSplit)
-			infof("New milestone hash '%v' pass: seen %v times within interval of %v msec", string(msgData), entry.Visits, interv)
+	quorum, timeInterval := getLmhsQuorum()
+	if int(entry.Visits) == quorum {
+		if withinQuorumInterval(&entry, timeInterval) {
+			toOutput(msgData, "lmhs")
+			infof("New milestone hash '%v' pass: seen %v times within interval of %v msec",
+				string(msgData), entry.Visits, entry.LastSeen-entry.FirstSeen)
+		} else {
+			updateLateQuorumCounter("lmhs")
 		}
 	}
 }
@@ -0,0 +1,108 @@
+package inputpart
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metrics are registered once per process
+var initTestMetrics sync.Once
+
+func newTestRoutine(uri string) *inputRoutine {
+	return &inputRoutine{
+		InputReaderBase: *inreaders.NewInputReaderBase(),
+		uri:             uri,
+	}
+}
+
+func getFilterDrops(r *inputRoutine) uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.filterDrops
+}
+
+func getFilterBlocked(uri string) float64 {
+	return testutil.ToFloat64(filterBlocked.With(map[string]string{"uri": uri}))
+}
+
+func queuedFrom() []string {
+	ret := make([]string, 0)
+	for len(toFilterChan) > 0 {
+		ret = append(ret, (<-toFilterChan).routine.uri)
+	}
+	return ret
+}
+
+// third message is put into the queue of size 2
+func Test_FilterQueuePolicies(t *testing.T) {
+	initTestMetrics.Do(initZmqMetrics)
+	savedChan := toFilterChan
+	savedPolicy := cfg.Config.FilterQueue.Policy
+	defer func() {
+		toFilterChan = savedChan
+		cfg.Config.FilterQueue.Policy = savedPolicy
+	}()
+
+	tests := []struct {
+		policy  string
+		queued  []string
+		drops   []uint64 // by routine
+		blocked float64  // increment of the blocked counter of the third routine
+	}{
+		{cfg.FilterQueueDropNewest, []string{"in1", "in2"}, []uint64{0, 0, 1}, 0},
+		{cfg.FilterQueueDropOldest, []string{"in2", "in3"}, []uint64{1, 0, 0}, 0},
+		{cfg.FilterQueueBlock, []string{"in2", "in3"}, []uint64{0, 0, 0}, 1},
+	}
+	for _, test := range tests {
+		cfg.Config.FilterQueue.Policy = test.policy
+		toFilterChan = make(chan *zmqMsg, 2)
+		routines := []*inputRoutine{newTestRoutine("in1"), newTestRoutine("in2"), newTestRoutine("in3")}
+		blockedBefore := getFilterBlocked("in3")
+		toFilter(routines[0], nil, nil, nil)
+		toFilter(routines[1], nil, nil, nil)
+
+		done := make(chan struct{})
+		go func() {
+			toFilter(routines[2], nil, nil, nil)
+			close(done)
+		}()
+		if test.policy == cfg.FilterQueueBlock {
+			// waiting until the input is blocked, then the filter takes the oldest message
+			deadline := time.Now().Add(time.Second)
+			for getFilterBlocked("in3") == blockedBefore && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			select {
+			case <-done:
+				t.Fatalf("%v: expected to wait while the queue is full", test.policy)
+			default:
+			}
+			<-toFilterChan
+		}
+		<-done
+
+		queued := queuedFrom()
+		if len(queued) != len(test.queued) {
+			t.Errorf("%v: expected queued messages from %v, got %v", test.policy, test.queued, queued)
+		} else {
+			for i := range queued {
+				if queued[i] != test.queued[i] {
+					t.Errorf("%v: expected queued messages from %v, got %v", test.policy, test.queued, queued)
+					break
+				}
+			}
+		}
+		for i, r := range routines {
+			if drops := getFilterDrops(r); drops != test.drops[i] {
+				t.Errorf("%v: expected %v drops of '%v', got %v", test.policy, test.drops[i], r.uri, drops)
+			}
+		}
+		if blocked := getFilterBlocked("in3") - blockedBefore; blocked != test.blocked {
+			t.Errorf("%v: expected blocked counter to grow by %v, got %v", test.policy, test.blocked, blocked)
+		}
+	}
+}
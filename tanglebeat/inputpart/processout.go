@@ -1,34 +1,28 @@
 package inputpart
 
 import (
-	"fmt"
-	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
 )
 
-func toOutput(msgData []byte, msgSplit []string) {
-	// publish message to output Nanomsg channel exactly as received from ZeroMQ. For others to consume
-	if err := compoundOutPublisher.PublishData(msgData); err != nil {
-		errorf("Error while publishing data: %v", err)
-	}
+func toOutput(msgData []byte, topic string) {
+	// publish message to outputs exactly as received from ZeroMQ. For others to consume
+	compoundOut.Publish(topic, msgData)
 	// update metrics based on compound (resulting) message stream (TPS, CTPS etc)
-	updateCompoundMetrics(msgSplit[0])
-	// analyze if this is value transaction. Process to collect necessary metrics
-	processValueTxMsg(msgSplit)
+	updateCompoundMetrics(topic)
 }
 
 // forming new message type
 // 'seen <tx_hash> <quorum filter level passed>'
 
 func publishQuorumUpdate(txHash string, timesSeen int) {
-	if !cfg.Config.QuorumUpdatesEnabled {
+	enabled, from, to := getQuorumUpdatesParams()
+	if !enabled {
 		return
 	}
-	if timesSeen < cfg.Config.QuorumUpdatesFrom || timesSeen > cfg.Config.QuorumUpdatesTo {
+	if timesSeen < from || timesSeen > to {
 		return
 	}
-	msgData := fmt.Sprintf("seen %s %d", txHash, timesSeen)
+	msg := &zmqmsg.SeenMsg{TxHash: txHash, TimesSeen: timesSeen}
 
-	if err := compoundOutPublisher.PublishData([]byte(msgData)); err != nil {
-		errorf("Error while publishing data: %v", err)
-	}
+	compoundOut.Publish("seen", zmqmsg.Join(msg.Split()))
 }
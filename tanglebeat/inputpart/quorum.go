@@ -1,15 +1,168 @@
 package inputpart
 
-import "github.com/unioproject/tanglebeat/tanglebeat/cfg"
+import (
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+)
+
+// quorum parameters can be changed while running by reloading the config
 
 func GetTxQuorum() int {
+	cfg.RLock()
+	defer cfg.RUnlock()
 	return cfg.Config.QuorumTxToPass
 }
 
 func GetSnQuorum() int {
-	return 3
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.QuorumSnToPass
 }
 
 func GetLmiQuorum() int {
-	return 3
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.QuorumLmiToPass
+}
+
+// time intervals in msec within which quorum must be reached. 0 means unlimited
+
+func getTxQuorumInterval() uint64 {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.TimeIntervalTxToPassMsec
+}
+
+func getSnQuorumInterval() uint64 {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.TimeIntervalSnToPassMsec
+}
+
+// checks if time between first and last (Nth) sighting of the message is within the interval
+func withinQuorumInterval(entry *hashcache.CacheEntry, intervalMsec uint64) bool {
+	if intervalMsec == 0 {
+		return true
+	}
+	return entry.LastSeen-entry.FirstSeen < intervalMsec
+}
+
+// returns quorum and time interval in msec within which it must be reached
+func getLmhsQuorum() (int, uint64) {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.QuorumMilestoneHashToPass, cfg.Config.TimeIntervalMilestoneHashToPassMsec
+}
+
+// returns if quorum updates are enabled and range of quorums
+func getQuorumUpdatesParams() (bool, int, int) {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.QuorumUpdatesEnabled, cfg.Config.QuorumUpdatesFrom, cfg.Config.QuorumUpdatesTo
+}
+
+// warns if some quorum is bigger than number of enabled inputs, i.e. messages can never pass.
+// With weighted quorum thresholds of tx, sn and extra topics are compared with the sum of configured
+// weights of enabled inputs instead. Auto adjusted weights are never bigger than configured
+// called at start and each time inputs or quorums are changed
+
+func CheckQuorums() {
+	type quorumParam struct {
+		name   string
+		quorum float64
+	}
+	enabled := inputRoutines.EnabledNames()
+	numInputs := float64(len(enabled))
+	var sumWeights float64
+	for _, uri := range enabled {
+		w, _ := getConfiguredWeight(uri)
+		sumWeights += w
+	}
+	weighted, txThreshold, snThreshold := getWeightedQuorumParams()
+	lmhsQuorum, _ := getLmhsQuorum()
+
+	byVisits := []quorumParam{
+		{"quorumLmiToPass", float64(GetLmiQuorum())},
+		{"quorumMilestoneHashToPass", float64(lmhsQuorum)},
+	}
+	var byWeight []quorumParam
+	if weighted {
+		byWeight = append(byWeight,
+			quorumParam{"weightedQuorum.txThreshold", txThreshold},
+			quorumParam{"weightedQuorum.snThreshold", snThreshold})
+	} else {
+		byVisits = append(byVisits,
+			quorumParam{"quorumToPass", float64(GetTxQuorum())},
+			quorumParam{"quorumSnToPass", float64(GetSnQuorum())})
+	}
+	for _, tf := range extraTopics {
+		q := quorumParam{"quorum of topic " + tf.Topic, float64(tf.Quorum)}
+		if weighted {
+			byWeight = append(byWeight, q)
+		} else {
+			byVisits = append(byVisits, q)
+		}
+	}
+	for _, q := range byVisits {
+		if q.quorum > numInputs {
+			warningf("%v = %v can never be reached with %v enabled input(s). Messages won't pass the filter",
+				q.name, q.quorum, numInputs)
+		}
+	}
+	for _, q := range byWeight {
+		if q.quorum > sumWeights {
+			warningf("%v = %v can never be reached: sum of weights of %v enabled input(s) is %v. Messages won't pass the filter",
+				q.name, q.quorum, numInputs, sumWeights)
+		}
+	}
+}
+
+// returns if weighted quorum is enabled and thresholds for tx and sn messages
+func getWeightedQuorumParams() (bool, float64, float64) {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	return cfg.Config.WeightedQuorum.Enabled, cfg.Config.WeightedQuorum.TxThreshold, cfg.Config.WeightedQuorum.SnThreshold
+}
+
+// returns weight of the input as configured, 1 by default, and if the weight must be adjusted by input stats
+func getConfiguredWeight(uri string) (float64, bool) {
+	cfg.RLock()
+	defer cfg.RUnlock()
+	w, ok := cfg.Config.WeightedQuorum.Weights[uri]
+	if !ok {
+		w = 1
+	}
+	return w, cfg.Config.WeightedQuorum.Auto
+}
+
+// true only once: when the last visit made the weight of the entry to reach the threshold.
+// Both weights are the ones stored in the cache, so the sum is never recalculated with different rounding
+func weightThresholdCrossed(entry *hashcache.CacheEntry, threshold float64) bool {
+	return float64(entry.WeightBefore) < threshold && float64(entry.Weight) >= threshold
+}
+
+// true only once, when the message reaches quorum: exact number of visits or weight threshold
+
+func txQuorumReached(entry *hashcache.CacheEntry) bool {
+	weighted, txThreshold, _ := getWeightedQuorumParams()
+	if weighted {
+		return weightThresholdCrossed(entry, txThreshold)
+	}
+	return int(entry.Visits) == GetTxQuorum()
+}
+
+func topicQuorumReached(entry *hashcache.CacheEntry, quorum int) bool {
+	weighted, _, _ := getWeightedQuorumParams()
+	if weighted {
+		return weightThresholdCrossed(entry, float64(quorum))
+	}
+	return int(entry.Visits) == quorum
+}
+
+func snQuorumReached(entry *hashcache.CacheEntry) bool {
+	weighted, _, snThreshold := getWeightedQuorumParams()
+	if weighted {
+		return weightThresholdCrossed(entry, snThreshold)
+	}
+	return int(entry.Visits) == GetSnQuorum()
 }
@@ -0,0 +1,55 @@
+package inputpart
+
+import (
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+	"testing"
+)
+
+// weighted quorum must be reached exactly once whatever the rounding of the sum of weights
+func Test_WeightedQuorumReachedOnce(t *testing.T) {
+	saved := cfg.Config.WeightedQuorum
+	defer func() { cfg.Config.WeightedQuorum = saved }()
+	cfg.Config.WeightedQuorum.Enabled = true
+	cfg.Config.WeightedQuorum.TxThreshold = 1
+	cfg.Config.WeightedQuorum.SnThreshold = 1
+
+	tests := []struct {
+		name    string
+		weights []float32
+		reached int // index of the visit which reaches quorum, -1 if never
+	}{
+		{"0.1, 0.9, 0.3", []float32{0.1, 0.9, 0.3}, 1},
+		{"0.7, 0.1, 0.2, 0.3", []float32{0.7, 0.1, 0.2, 0.3}, 2},
+		{"1, 1", []float32{1, 1}, 0},
+		{"0.5, 0.5, 0.5", []float32{0.5, 0.5, 0.5}, 1},
+		{"0.3, 0.3, 0.3", []float32{0.3, 0.3, 0.3}, -1},
+		{"zero weight", []float32{0.5, 0, 0.5}, 2},
+	}
+	quorumReached := map[string]func(entry *hashcache.CacheEntry) bool{
+		"tx":    txQuorumReached,
+		"sn":    snQuorumReached,
+		"topic": func(entry *hashcache.CacheEntry) bool { return topicQuorumReached(entry, 1) },
+	}
+	for _, test := range tests {
+		for kind, reached := range quorumReached {
+			cache := hashcache.NewHashCacheBase("test", 0, 60, 600)
+			var entry hashcache.CacheEntry
+			got := -1
+			for i, w := range test.weights {
+				cache.SeenHashByWeighted("HASH", byte(i), w, nil, &entry)
+				if !reached(&entry) {
+					continue
+				}
+				if got >= 0 {
+					t.Errorf("%v, %v: quorum reached again at visit %v", test.name, kind, i)
+					continue
+				}
+				got = i
+			}
+			if got != test.reached {
+				t.Errorf("%v, %v: expected quorum at visit %v, got %v", test.name, kind, test.reached, got)
+			}
+		}
+	}
+}
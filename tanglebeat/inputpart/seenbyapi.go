@@ -0,0 +1,87 @@
+package inputpart
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"net/http"
+	"strings"
+)
+
+// forensics: which inputs have seen the transaction or confirmation hash
+
+type seenBySource struct {
+	Id  byte   `json:"id"`
+	Uri string `json:"uri"` // empty if input was removed
+}
+
+type seenByEntry struct {
+	FirstSeen uint64         `json:"firstSeen"`
+	LastSeen  uint64         `json:"lastSeen"`
+	Visits    int            `json:"visits"`
+	Weight    float32        `json:"weight"`
+	Sources   []seenBySource `json:"sources"`
+}
+
+type seenByResponse struct {
+	Hash string       `json:"hash"`
+	TX   *seenByEntry `json:"tx,omitempty"`
+	SN   *seenByEntry `json:"sn,omitempty"`
+}
+
+func getInputUrisById() map[byte]string {
+	ret := make(map[byte]string)
+	inputRoutines.ForEach(func(name string, ir inreaders.InputReader) {
+		ir.Lock()
+		ret[ir.GetId__()] = name
+		ir.Unlock()
+	})
+	return ret
+}
+
+// implemented by HashCacheBase and ShardedHashCache
+type hashFinder interface {
+	FindNoTouch(hash string, ret *hashcache.CacheEntry) bool
+}
+
+func getSeenByEntry(cache hashFinder, hash string, uris map[byte]string) *seenByEntry {
+	var entry hashcache.CacheEntry
+	if !cache.FindNoTouch(hash, &entry) {
+		return nil
+	}
+	ret := &seenByEntry{
+		FirstSeen: entry.FirstSeen,
+		LastSeen:  entry.LastSeen,
+		Visits:    int(entry.Visits),
+		Weight:    entry.Weight,
+		Sources:   make([]seenBySource, 0, entry.Sources.Count()),
+	}
+	entry.Sources.ForEach(func(id byte) {
+		ret.Sources = append(ret.Sources, seenBySource{Id: id, Uri: uris[id]})
+	})
+	return ret
+}
+
+// GET /api1/seenby/<hash>
+
+func HandlerSeenBy(w http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api1/seenby"), "/")
+	if hash == "" {
+		http.Error(w, "hash is missing. Expected /api1/seenby/<hash>", http.StatusBadRequest)
+		return
+	}
+	uris := getInputUrisById()
+	resp := &seenByResponse{
+		Hash: hash,
+		TX:   getSeenByEntry(txcache, hash, uris),
+		SN:   getSeenByEntry(&sncache.HashCacheBase, hash, uris),
+	}
+	data, err := json.MarshalIndent(resp, "", "   ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error while marshaling response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
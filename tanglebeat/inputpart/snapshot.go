@@ -0,0 +1,230 @@
+package inputpart
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+	"os"
+	"path"
+	"time"
+)
+
+// hash caches are saved to snapshot files periodically and after the filter is stopped.
+// Upon start they are restored, so that quorums, bundles and echoes are not lost with restart of the hub
+
+var snapshotDone = make(chan struct{}) // closed when the final snapshot is saved
+
+// each shard of the tx cache is saved to its own file
+func snapshotCaches() []*hashcache.HashCacheBase {
+	ret := append([]*hashcache.HashCacheBase{}, txcache.Shards()...)
+	return append(ret,
+		&sncache.HashCacheBase,
+		lmhsCache,
+		topicCache,
+		&transferBundleCache.HashCacheBase,
+		echoBuffer,
+	)
+}
+
+func snapshotFileName(cache *hashcache.HashCacheBase) string {
+	return path.Join(cfg.Config.CacheSnapshot.Dir, cache.GetID()+".snapshot")
+}
+
+// must be called after caches are created and before inputs are started
+func initCacheSnapshots(ctx context.Context) {
+	transferBundleCache.SetDataCodec(bundleDataCodec{})
+	echoBuffer.SetDataCodec(echoDataCodec{})
+
+	if !cfg.Config.CacheSnapshot.Enabled {
+		close(snapshotDone)
+		return
+	}
+	if err := os.MkdirAll(cfg.Config.CacheSnapshot.Dir, 0755); err != nil {
+		errorf("Cache snapshots are disabled: %v", err)
+		close(snapshotDone)
+		return
+	}
+	restoreCaches()
+	go saveSnapshotsLoop(ctx)
+}
+
+// each input gets the id it had when snapshots were saved, so restored entries are attributed to the same inputs.
+// If snapshots disagree (the input was replaced between saving two of them), ids of the first restored
+// snapshot are kept and conflicting ids of other snapshots are not restored
+type snapshotInputIds struct {
+	ids   map[string]byte
+	names map[byte]string
+}
+
+func (s *snapshotInputIds) remap(id byte, uri string) (byte, bool) {
+	if ret, ok := s.ids[uri]; ok {
+		return ret, true
+	}
+	if _, ok := s.names[id]; ok {
+		return 0, false
+	}
+	s.ids[uri] = id
+	s.names[id] = uri
+	return id, true
+}
+
+// must be called before inputs are created
+func restoreCaches() {
+	inputIds := &snapshotInputIds{
+		ids:   make(map[string]byte),
+		names: make(map[byte]string),
+	}
+	for _, cache := range snapshotCaches() {
+		fname := snapshotFileName(cache)
+		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			infof("Snapshot of '%v' not found", cache.GetID())
+			continue
+		}
+		num, err := cache.LoadSnapshot(fname, inputIds.remap)
+		if err != nil {
+			errorf("Failed to restore '%v' from snapshot: %v", cache.GetID(), err)
+			continue
+		}
+		infof("Restored %v entries of '%v' from snapshot '%v'", num, cache.GetID(), fname)
+	}
+	inputRoutines.SetOldIds(inputIds.ids)
+}
+
+func saveSnapshots() {
+	inputIds := inputRoutines.IdNames()
+	for _, cache := range snapshotCaches() {
+		fname := snapshotFileName(cache)
+		num, err := cache.SaveSnapshot(fname, inputIds)
+		if err != nil {
+			errorf("Failed to save snapshot of '%v': %v", cache.GetID(), err)
+			continue
+		}
+		debugf("Saved %v entries of '%v' to snapshot '%v'", num, cache.GetID(), fname)
+	}
+}
+
+// final snapshot is saved when all messages in the filter queue are processed
+func saveSnapshotsLoop(ctx context.Context) {
+	defer close(snapshotDone)
+
+	ticker := time.NewTicker(time.Duration(cfg.Config.CacheSnapshot.EveryMin) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveSnapshots()
+		case <-ctx.Done():
+			<-filterDone
+			saveSnapshots()
+			infof("Cache snapshots saved")
+			return
+		}
+	}
+}
+
+// data of entries are encoded with gob through exported copies of the structures
+
+type bundleEntrySnapshot struct {
+	Addr  string
+	Value int64
+}
+
+type transferBundleDataSnapshot struct {
+	Hash         string
+	Entries      []bundleEntrySnapshot
+	Inconsistent bool
+	Counted      bool
+	PostedValue  int64
+	Posted       bool
+	Confirmed    bool
+	FirstTxTs    uint64
+	ConfirmedTs  uint64
+	NumUpdate    int
+}
+
+type bundleDataCodec struct{}
+
+func (bundleDataCodec) Encode(data interface{}) ([]byte, error) {
+	d := data.(*transferBundleData)
+	s := transferBundleDataSnapshot{
+		Hash:         d.hash,
+		Entries:      make([]bundleEntrySnapshot, len(d.entries)),
+		Inconsistent: d.inconsistent,
+		Counted:      d.counted,
+		PostedValue:  d.postedValue,
+		Posted:       d.posted,
+		Confirmed:    d.confirmed,
+		FirstTxTs:    d.firstTxTs,
+		ConfirmedTs:  d.confirmedTs,
+		NumUpdate:    d.numUpdate,
+	}
+	for i, e := range d.entries {
+		s.Entries[i] = bundleEntrySnapshot{Addr: e.addr, Value: e.value}
+	}
+	return gobEncode(&s)
+}
+
+func (bundleDataCodec) Decode(buf []byte) (interface{}, error) {
+	var s transferBundleDataSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&s); err != nil {
+		return nil, err
+	}
+	ret := &transferBundleData{
+		hash:         s.Hash,
+		entries:      make([]bundleEntry, len(s.Entries)),
+		inconsistent: s.Inconsistent,
+		counted:      s.Counted,
+		postedValue:  s.PostedValue,
+		posted:       s.Posted,
+		confirmed:    s.Confirmed,
+		firstTxTs:    s.FirstTxTs,
+		confirmedTs:  s.ConfirmedTs,
+		numUpdate:    s.NumUpdate,
+	}
+	for i, e := range s.Entries {
+		ret.entries[i] = bundleEntry{addr: e.Addr, value: e.Value}
+	}
+	return ret, nil
+}
+
+type echoEntrySnapshot struct {
+	WhenSent     uint64
+	Seen         bool
+	WhenSeenLast uint64
+	WhenSeenNth  [whenSeenArrayLen]uint64
+}
+
+type echoDataCodec struct{}
+
+func (echoDataCodec) Encode(data interface{}) ([]byte, error) {
+	d := data.(*echoEntry)
+	return gobEncode(&echoEntrySnapshot{
+		WhenSent:     d.whenSent,
+		Seen:         d.seen,
+		WhenSeenLast: d.whenSeenLast,
+		WhenSeenNth:  d.whenSeenNth,
+	})
+}
+
+func (echoDataCodec) Decode(buf []byte) (interface{}, error) {
+	var s echoEntrySnapshot
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &echoEntry{
+		whenSent:     s.WhenSent,
+		seen:         s.Seen,
+		whenSeenLast: s.WhenSeenLast,
+		whenSeenNth:  s.WhenSeenNth,
+	}, nil
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
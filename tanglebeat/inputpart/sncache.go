@@ -31,7 +31,8 @@ func (cache *hashCacheSN) checkCurrentMilestoneIndex(index int, uri string) (boo
 		return false, cache.indexChanged
 	}
 	// milestone index is considered changed only when seen from two different zmq hosts
-	if cache.largestIndexCandidate == index && cache.largestIndexCandidateUri != uri {
+	// unless lmi quorum is 1
+	if GetLmiQuorum() <= 1 || (cache.largestIndexCandidate == index && cache.largestIndexCandidateUri != uri) {
 		debugf("------ milestone index changed %v --> %v ", cache.largestIndex, index)
 		cache.largestIndex = index
 		cache.indexChanged = utils.UnixMsNow()
@@ -0,0 +1,98 @@
+package inputpart
+
+import (
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
+)
+
+// Topics other than tx, sn, lmi and lmhs (e.g. lmsi, tx_trytes or address topics) are passed
+// by the generic quorum filter configured in 'extraTopics'.
+// Each input subscribes to topics listed for its uri in 'inputTopics' or to all known topics by default
+
+var defaultTopics = []string{"tx", "sn", "lmi", "lmhs"}
+
+const segmentDurationTopicSec = 60
+
+var (
+	topicCache  *hashcache.HashCacheBase
+	extraTopics map[string]*cfg.TopicFilter
+)
+
+func initTopicFilter(retentionPeriodSec int) {
+	extraTopics = make(map[string]*cfg.TopicFilter)
+	for i := range cfg.Config.ExtraTopics {
+		tf := &cfg.Config.ExtraTopics[i]
+		if utils.StringInSlice(tf.Topic, defaultTopics) {
+			errorf("Topic '%v' can't be configured as extra topic. Ignored", tf.Topic)
+			continue
+		}
+		extraTopics[tf.Topic] = tf
+	}
+	// keys are 'topic key', hashed as a whole
+	topicCache = hashcache.NewHashCacheBase("topiccache", 0, segmentDurationTopicSec, retentionPeriodSec)
+}
+
+// topics the input subscribes to. Inputs in tx_trytes mode subscribe to 'tx_trytes' instead of 'tx'
+func getInputTopics(uri string) []string {
+	var ret []string
+	if t, ok := cfg.Config.InputTopics[uri]; ok {
+		ret = append(ret, t...)
+	} else {
+		ret = append(ret, defaultTopics...)
+		for _, tf := range cfg.Config.ExtraTopics {
+			ret = append(ret, tf.Topic)
+		}
+	}
+	if isTxTrytesInput(uri) {
+		for i := range ret {
+			if ret[i] == "tx" {
+				ret[i] = "tx_trytes"
+			}
+		}
+	}
+	return ret
+}
+
+// messages with topics which are not known to the filter are discarded
+func knownTopic(topic string) bool {
+	if utils.StringInSlice(topic, defaultTopics) {
+		return true
+	}
+	_, ok := extraTopics[topic]
+	return ok
+}
+
+func checkInputTopics() {
+	for uri, topics := range cfg.Config.InputTopics {
+		for _, t := range topics {
+			if !knownTopic(t) {
+				warningf("Topic '%v' of input %v is not known to the filter, messages will be discarded", t, uri)
+			}
+		}
+	}
+}
+
+func filterExtraTopicMsg(routine *inputRoutine, msgData []byte, msgSplit []string, tf *cfg.TopicFilter) {
+	if len(msgSplit) <= tf.KeyField {
+		errorf("%v: Message %v is invalid: expected key at index %v", routine.GetUri(), string(msgData), tf.KeyField)
+		return
+	}
+	if routine.IsOutputClosed() {
+		return // not putting into the cache
+	}
+	var entry hashcache.CacheEntry
+
+	weight := routine.getWeight()
+	topicCache.SeenHashByWeighted(tf.Topic+" "+msgSplit[tf.KeyField], routine.GetId__(), weight, nil, &entry)
+	if entry.Repeated {
+		return
+	}
+	if topicQuorumReached(&entry, tf.Quorum) {
+		if withinQuorumInterval(&entry, tf.TimeIntervalMsec) {
+			toOutput(msgData, tf.Topic)
+		} else {
+			updateLateQuorumCounter(tf.Topic)
+		}
+	}
+}
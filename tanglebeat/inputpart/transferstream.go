@@ -0,0 +1,58 @@
+package inputpart
+
+import (
+	"context"
+	"fmt"
+	"github.com/unioproject/tanglebeat/tanglebeat/outsink"
+	"net/http"
+	"strconv"
+)
+
+// Each newly confirmed transfer is sent as the JSON event to clients of /api1/stream/transfers.
+// Value is the value moved by the bundle, as it is counted in the transfer volume metrics
+
+type confirmedTransfer struct {
+	Bundle      string `json:"bundle"`
+	Value       int64  `json:"value"`
+	NumEntries  int    `json:"numEntries"`
+	FirstSeen   uint64 `json:"firstSeen"`   // unix ms
+	ConfirmedTs uint64 `json:"confirmedTs"` // unix ms
+}
+
+const transferStreamBufferSize = 100
+
+var transferStream *outsink.EventStream
+
+func initTransferStream(ctx context.Context) {
+	transferStream = outsink.NewEventStream(ctx, "/api1/stream/transfers", transferStreamBufferSize)
+}
+
+func publishConfirmedTransfer(data *transferBundleData, valueMoved int64, firstSeen uint64) {
+	transferStream.PublishEvent(&confirmedTransfer{
+		Bundle:      data.hash,
+		Value:       valueMoved,
+		NumEntries:  len(data.entries),
+		FirstSeen:   firstSeen,
+		ConfirmedTs: data.confirmedTs,
+	})
+}
+
+// GET /api1/stream/transfers[?minValue=<iotas>]
+
+func HandlerTransferStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var minValue int64
+	if s := r.URL.Query().Get("minValue"); s != "" {
+		var err error
+		if minValue, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("wrong minValue '%v'", s), http.StatusBadRequest)
+			return
+		}
+	}
+	transferStream.Serve(w, r, func(ev interface{}) bool {
+		return ev.(*confirmedTransfer).Value >= minValue
+	})
+}
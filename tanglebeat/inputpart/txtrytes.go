@@ -0,0 +1,61 @@
+package inputpart
+
+import (
+	"fmt"
+	"github.com/iotaledger/iota.go/transaction"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+)
+
+// Inputs listed in 'txTrytesInputs' subscribe to 'tx_trytes' instead of 'tx'.
+// Raw trytes are parsed locally and the hash of the transaction is calculated from the trytes,
+// so the hub does not trust text output of the node. The 'tx' message is synthesized by the hub
+// and filtered the same way as if it was received from the node
+
+func isTxTrytesInput(uri string) bool {
+	return utils.StringInSlice(uri, cfg.Config.TxTrytesInputs)
+}
+
+// 'tx_trytes <trytes> <hash>'
+func parseTxTrytesMsg(msgSplit []string) (*transaction.Transaction, error) {
+	if len(msgSplit) < 3 {
+		return nil, fmt.Errorf("expected at least 3 fields in tx_trytes message")
+	}
+	// hash is calculated from trytes
+	tx, err := transaction.AsTransactionObject(msgSplit[1])
+	if err != nil {
+		return nil, err
+	}
+	if tx.Hash != msgSplit[2] {
+		return nil, fmt.Errorf("hash mismatch: calculated %v, received %v", tx.Hash, msgSplit[2])
+	}
+	return tx, nil
+}
+
+func synthesizeTxMsg(msgSplit []string) ([]byte, []string, error) {
+	tx, err := parseTxTrytesMsg(msgSplit)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret := txMsgFromTransaction(tx).Split()
+	return zmqmsg.Join(ret), ret, nil
+}
+
+// synthesized message has the same format as 'tx' message of IRI
+func txMsgFromTransaction(tx *transaction.Transaction) *zmqmsg.TxMsg {
+	return &zmqmsg.TxMsg{
+		Hash:         tx.Hash,
+		Address:      tx.Address,
+		Value:        tx.Value,
+		ObsoleteTag:  tx.ObsoleteTag,
+		Timestamp:    tx.Timestamp,
+		CurrentIndex: int(tx.CurrentIndex),
+		LastIndex:    int(tx.LastIndex),
+		Bundle:       tx.Bundle,
+		Trunk:        tx.TrunkTransaction,
+		Branch:       tx.BranchTransaction,
+		ArrivalTime:  utils.UnixMsNow() / 1000,
+		Tag:          tx.Tag,
+	}
+}
@@ -2,9 +2,9 @@ package inputpart
 
 import (
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/lib/zmqmsg"
 	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
-	"strconv"
 	"time"
 )
 
@@ -25,6 +25,8 @@ type transferBundleData struct {
 	postedValue  int64
 	posted       bool
 	confirmed    bool
+	firstTxTs    uint64 // when the first tx of the bundle passed quorum, unix ms
+	confirmedTs  uint64 // when the bundle was marked confirmed, unix ms
 	numUpdate    int
 }
 
@@ -32,10 +34,13 @@ var transferBundleCache *bundleCache
 
 const segmentDurationBundleCacheSec = 10 * 60
 
+// bundle cache is keyed by the whole bundle hash, not by first trytes as tx and sn caches:
+// bundles with the same prefix would be merged otherwise.
+// Full hash is still compared, because keys of long hashes are hashes of them
 func initValueTx() {
-	transferBundleCache = newBundleCache(
-		useFirstHashTrytes, segmentDurationBundleCacheSec, cfg.Config.RetentionPeriodMin*60)
+	transferBundleCache = newBundleCache(0, segmentDurationBundleCacheSec, cfg.Config.RetentionPeriodMin*60)
 
+	initBundleConfTimes()
 	go updateBundleMetricsLoop()
 }
 
@@ -49,7 +54,7 @@ func newBundleCache(hashLen int, segmentDurationSec int, retentionPeriodSec int)
 const maxBundleSize = 100
 
 func (cache *bundleCache) updateBundleData(bundleHash, addr string, value int64, idx, lastIdx int) {
-	if idx > lastIdx || lastIdx > maxBundleSize || lastIdx < 0 {
+	if idx < 0 || idx > lastIdx || lastIdx > maxBundleSize {
 		errorf("Bundle '%v' is inconsistent or too big", bundleHash)
 		return
 	}
@@ -60,12 +65,16 @@ func (cache *bundleCache) updateBundleData(bundleHash, addr string, value int64,
 	var entry hashcache.CacheEntry
 	var data *transferBundleData
 
-	shash := cache.ShortHash(bundleHash)
-	seen := cache.FindNolock(shash, &entry, true)
+	key := cache.HashKey(bundleHash)
+	seen := cache.FindNolock(key, &entry, true)
 
 	if seen {
 		debugf("Bundle '%v' updating entry. Tx value = %v", bundleHash, value)
 		data = entry.Data.(*transferBundleData)
+		if data.hash != bundleHash {
+			errorf("Bundle '%v' has the same key as bundle '%v'. Ignored", bundleHash, data.hash)
+			return
+		}
 		if idx >= len(data.entries) {
 			errorf("Bundle '%v': tx index is out of bounds", bundleHash)
 			return
@@ -86,12 +95,13 @@ func (cache *bundleCache) updateBundleData(bundleHash, addr string, value int64,
 	} else {
 		debugf("Bundle '%v' creating new bundle entry. Tx value = %v", bundleHash, value)
 		data = &transferBundleData{
-			hash:    shash,
-			entries: make([]bundleEntry, lastIdx+1, lastIdx+1),
+			hash:      bundleHash,
+			entries:   make([]bundleEntry, lastIdx+1, lastIdx+1),
+			firstTxTs: utils.UnixMsNow(),
 		}
 		data.entries[idx].addr = addr
 		data.entries[idx].value = value
-		cache.InsertNewNolock(shash, 0, data)
+		cache.InsertNewNolock(key, 0, data)
 	}
 	data.numUpdate++
 	data.posted = false
@@ -109,9 +119,17 @@ func (cache *bundleCache) markConfirmed(bundleHash string) {
 	defer transferBundleCache.Unlock()
 
 	data = entry.Data.(*transferBundleData)
+	if data.hash != bundleHash {
+		return // other bundle with the same key
+	}
 	if !data.confirmed {
 		data.confirmed = true
-		debugf("Bundle %v... marked CONFIRMED", data.hash)
+		data.confirmedTs = utils.UnixMsNow()
+		debugf("Bundle %v marked CONFIRMED", data.hash)
+		// bundles restored from older snapshots don't have time of the first tx
+		if data.firstTxTs != 0 && data.confirmedTs >= data.firstTxTs {
+			recordBundleConfTime(data.confirmedTs - data.firstTxTs)
+		}
 	}
 }
 
@@ -197,12 +215,13 @@ func updateBundleMetricsLoop() {
 			if deltaValue == 0 {
 				return
 			}
-			debugf("++++++ Bundle %v...: deltaValueMoved = %v", data.hash, deltaValue)
+			debugf("++++++ Bundle %v: deltaValueMoved = %v", data.hash, deltaValue)
 
 			if !data.counted {
 				data.counted = true
 				newConfirmedBundles++
-				debugf("++++++ Bundle %v...: counting new", data.hash)
+				debugf("++++++ Bundle %v: counting new", data.hash)
+				publishConfirmedTransfer(data, valueMoved, entry.FirstSeen)
 			}
 			data.postedValue = valueMoved
 			data.posted = true
@@ -221,35 +240,16 @@ func updateBundleMetricsLoop() {
 	}
 }
 
-func processValueTxMsg(msgSplit []string) {
-	var idx, idxLast int
-
-	switch msgSplit[0] {
-	case "tx":
-		if len(msgSplit) < 9 {
-			errorf("toOutput: expected at least 9 fields in TX message")
-			return
-		}
-		value, err := strconv.Atoi(msgSplit[3])
-		if err != nil {
-			errorf("toOutput: expected integer in value field")
-			return
-		}
-		if value != 0 {
-			idx, _ = strconv.Atoi(msgSplit[6])
-			idxLast, _ = strconv.Atoi(msgSplit[7])
-
-			transferBundleCache.updateBundleData(msgSplit[8], msgSplit[2], int64(value), idx, idxLast)
-		}
-	case "sn":
-		if len(msgSplit) < 7 {
-			errorf("toOutput: expected at least 7 fields in SN message")
-			return
-		}
-		transferBundleCache.markConfirmed(msgSplit[6])
+func processValueTx(tx *zmqmsg.TxMsg) {
+	if tx.Value != 0 {
+		transferBundleCache.updateBundleData(tx.Bundle, tx.Address, tx.Value, tx.CurrentIndex, tx.LastIndex)
 	}
 }
 
+func processConfirmation(sn *zmqmsg.SnMsg) {
+	transferBundleCache.markConfirmed(sn.Bundle)
+}
+
 // return num confirmed bundles, total value without last in bundle
 func getValueConfirmationStats(msecBack uint64) (int, int64) {
 	var confBundles int
@@ -20,6 +20,8 @@ type ZmqOutputStatsStruct struct {
 
 	ConfirmedTransferCount int   `json:"confirmedValueBundleCount"`
 	ValueVolumeApprox      int64 `json:"valueVolumeApprox"`
+
+	ValueBundleConfTime BundleConfTimeStats `json:"valueBundleConfTimeSec"`
 }
 
 type ZmqCacheStatsStruct struct {
@@ -177,6 +179,7 @@ func updateZmqOutputSlowStats() {
 		st.ConfRate = (st.SNCount * 100) / st.TXCount
 	}
 	st.ConfirmedTransferCount, st.ValueVolumeApprox = getValueConfirmationStats(0)
+	st.ValueBundleConfTime = getBundleConfTimeStats(retentionPeriodSec * 1000)
 
 	// 10 min stats
 	const secBack10min = 10 * 60
@@ -201,6 +204,7 @@ func updateZmqOutputSlowStats() {
 		st10.ConfRate = (st10.SNCount * 100) / st10.TXCount
 	}
 	st10.ConfirmedTransferCount, st10.ValueVolumeApprox = getValueConfirmationStats(secBack10min * 1000)
+	st10.ValueBundleConfTime = getBundleConfTimeStats(secBack10min * 1000)
 
 	zmqOutputStatsMutex.Lock() //----
 	*zmqOutputStats = st
@@ -2,6 +2,7 @@ package inreaders
 
 import (
 	"github.com/unioproject/tanglebeat/lib/utils"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -9,11 +10,20 @@ import (
 // InputReader is abstract interface to the object with go routine which reads input from
 // ZeroMQ, Nanomsg or similar data sources
 // Upon i/o error routines stops running. Then starter routine restarts it again after some time
+// Running routine is expected to listen to the stop channel and to leave Run as soon as it is closed
 
 type InputReader interface {
 	setRunning__()
 	setIdle__(time.Duration, ReasonNotRunning)
 	isTimeToRestart__() bool
+	isEnabled__() bool
+	setEnabled__(bool)
+	stop__()
+	isStopRequested__() bool
+	putOnHold__(time.Duration, ReasonNotRunning)
+	takeHold__() (time.Duration, ReasonNotRunning)
+	nextRestartDelay__(ReasonNotRunning, *backoffParams) time.Duration
+	wasStartedBefore__() bool
 
 	SetId__(byte)
 	GetId__() byte
@@ -43,6 +53,7 @@ const (
 	REASON_NORUN_ONHOLD_15MIN ReasonNotRunning = "onHold15min"
 	REASON_NORUN_ONHOLD_30MIN ReasonNotRunning = "onHold30min"
 	REASON_NORUN_ONHOLD_1H    ReasonNotRunning = "onHold1h"
+	REASON_NORUN_DISABLED     ReasonNotRunning = "disabled"
 )
 
 type InputReaderBase struct {
@@ -50,7 +61,14 @@ type InputReaderBase struct {
 	running          bool
 	reading          bool
 	outputClosed     bool
+	disabled         bool
+	stopRequested    bool
+	chStop           chan struct{}
+	holdFor          time.Duration // if not 0, stopped routine is restarted after that
+	holdReason       ReasonNotRunning
 	reasonNotRunning ReasonNotRunning
+	restarts         uint64
+	failures         uint // consecutive failures, exponent of the backoff
 	lastErr          string
 	restartAt        time.Time
 	ReadingSince     time.Time
@@ -60,10 +78,12 @@ type InputReaderBase struct {
 
 type InputReaderBaseStats struct {
 	Running         bool   `json:"running"`
+	Enabled         bool   `json:"enabled"`
 	LastErr         string `json:"lastErr"`
 	RunningSinceTs  uint64 `json:"runningSince"`
 	LastHeartbeatTs uint64 `json:"lastHeartbeat"`
 	OutputClosed    bool   `json:"outputClosed"`
+	Restarts        uint64 `json:"restarts"`
 }
 
 func NewInputReaderBase() *InputReaderBase {
@@ -130,12 +150,120 @@ func (r *InputReaderBase) isRunning__() bool {
 	return r.running
 }
 
+func (r *InputReaderBase) wasStartedBefore__() bool {
+	return r.chStop != nil
+}
+
 func (r *InputReaderBase) setRunning__() {
+	if r.wasStartedBefore__() {
+		r.restarts++
+	}
 	r.running = true
+	r.stopRequested = false
+	r.chStop = make(chan struct{})
+}
+
+func (r *InputReaderBase) isEnabled__() bool {
+	return !r.disabled
+}
+
+func (r *InputReaderBase) setEnabled__(enabled bool) {
+	r.disabled = !enabled
+	if enabled {
+		r.restartAt = time.Now()
+		r.reasonNotRunning = REASON_NORUN_NONE
+	} else {
+		r.reasonNotRunning = REASON_NORUN_DISABLED
+	}
+}
+
+// closes stop channel of the running routine. Does nothing if routine is not running
+func (r *InputReaderBase) stop__() {
+	if !r.running || r.stopRequested {
+		return
+	}
+	r.stopRequested = true
+	close(r.chStop)
+}
+
+// stops running routine and prevents restarting it for the duration
+func (r *InputReaderBase) putOnHold__(d time.Duration, reason ReasonNotRunning) {
+	if !r.running {
+		return
+	}
+	r.holdFor = d
+	r.holdReason = reason
+	r.stop__()
+}
+
+// returns and resets hold duration and reason of the stopped routine
+func (r *InputReaderBase) takeHold__() (time.Duration, ReasonNotRunning) {
+	d, reason := r.holdFor, r.holdReason
+	r.holdFor = 0
+	r.holdReason = REASON_NORUN_NONE
+	return d, reason
+}
+
+func (r *InputReaderBase) isStopRequested__() bool {
+	return r.stopRequested
+}
+
+// returns channel which is closed when the running routine is requested to stop
+func (r *InputReaderBase) GetStopChan() <-chan struct{} {
+	r.RLock()
+	defer r.RUnlock()
+	return r.chStop
+}
+
+func (r *InputReaderBase) IsStopRequested() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.stopRequested
+}
+
+// delay after errors grows exponentially up to the maximum, it is reset after period of healthy reading.
+// All delays except after disabling are randomized to avoid restarting many readers at once
+func (r *InputReaderBase) nextRestartDelay__(reason ReasonNotRunning, bp *backoffParams) time.Duration {
+	if r.reading && time.Since(r.ReadingSince) >= bp.resetAfter {
+		r.failures = 0
+	}
+	var ret time.Duration
+	switch reason {
+	case REASON_NORUN_ONHOLD_10MIN:
+		ret = 10 * time.Minute
+	case REASON_NORUN_ONHOLD_15MIN:
+		ret = 15 * time.Minute
+	case REASON_NORUN_ONHOLD_30MIN:
+		ret = 30 * time.Minute
+	case REASON_NORUN_ONHOLD_1H:
+		ret = 1 * time.Hour
+	case REASON_NORUN_ERROR:
+		ret = bp.max
+		if r.failures < 32 && bp.base<<r.failures < bp.max {
+			ret = bp.base << r.failures
+			r.failures++
+		}
+	case REASON_NORUN_DISABLED:
+		// restarted immediately if enabled again while stopping
+		return 0
+	default:
+		ret = 1 * time.Minute
+	}
+	return withJitter(ret, bp.jitter)
+}
+
+// randomizes duration by +-jitter fraction
+func withJitter(d time.Duration, jitter float64) time.Duration {
+	delta := int64(float64(d) * jitter)
+	if delta <= 0 {
+		return d
+	}
+	return d - time.Duration(delta) + time.Duration(rand.Int63n(2*delta+1))
 }
 
 func (r *InputReaderBase) setIdle__(restartAfter time.Duration, reason ReasonNotRunning) {
 	r.running = false
+	r.reading = false
 	r.reasonNotRunning = reason
 	r.restartAt = time.Now().Add(restartAfter)
 }
@@ -151,9 +279,11 @@ func (r *InputReaderBase) isTimeToRestart__() bool {
 func (r *InputReaderBase) GetReaderBaseStats__() *InputReaderBaseStats {
 	return &InputReaderBaseStats{
 		Running:         r.running && r.reading,
+		Enabled:         !r.disabled,
 		LastErr:         r.lastErr,
 		RunningSinceTs:  utils.UnixMs(r.ReadingSince),
 		LastHeartbeatTs: utils.UnixMs(r.lastHeartbeat),
 		OutputClosed:    r.outputClosed,
+		Restarts:        r.restarts,
 	}
 }
@@ -1,25 +1,91 @@
 package inreaders
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
 
+const (
+	maxNumInputReaders = 256 // ids of readers are bytes
+	starterLoopPeriod  = 1 * time.Second
+)
+
+// restart delays after errors grow exponentially: base, 2*base, 4*base ... up to max.
+// Counter of failures is reset when reader was reading longer than resetAfter
+type backoffParams struct {
+	base       time.Duration
+	max        time.Duration
+	resetAfter time.Duration
+	jitter     float64 // delays are randomized by +-jitter fraction
+}
+
 type InputReaderSet struct {
 	sync.RWMutex
-	name   string // for logging
-	theSet map[string]InputReader
+	name      string // for logging
+	theSet    map[string]InputReader
+	usedIds   [maxNumInputReaders]bool
+	nextId    int
+	oldIds    map[string]byte // ids of readers which are not in the set, see allocId
+	backoff   backoffParams
+	onRestart func(name string)
+	ctx       context.Context
+	wg        sync.WaitGroup // starter and running readers
 }
 
-func NewInputReaderSet(name string) *InputReaderSet {
+// when the context is cancelled, running readers are requested to stop and not restarted anymore
+func NewInputReaderSet(ctx context.Context, name string) *InputReaderSet {
 	ret := &InputReaderSet{
 		name:   name,
 		theSet: make(map[string]InputReader),
+		oldIds: make(map[string]byte),
+		ctx:    ctx,
+		backoff: backoffParams{
+			base:       15 * time.Second,
+			max:        10 * time.Minute,
+			resetAfter: 5 * time.Minute,
+			jitter:     0.2,
+		},
+		onRestart: func(string) {},
 	}
+	ret.wg.Add(1)
 	go ret.runStarter()
 	return ret
 }
 
+// waits until the starter and all readers stopped after the context of the set was cancelled
+func (irs *InputReaderSet) Wait() {
+	irs.wg.Wait()
+}
+
+func (irs *InputReaderSet) stopAll() {
+	readers, _, _ := irs.snapshot()
+	for name, ir := range readers {
+		ir.Lock()
+		ir.stop__()
+		ir.Unlock()
+		debugf("Routine set '%v': stopping routine '%v'", irs.name, name)
+	}
+}
+
+// must be called before readers are added
+func (irs *InputReaderSet) SetBackoffParams(base, max, resetAfter time.Duration, jitter float64) {
+	irs.Lock()
+	defer irs.Unlock()
+	irs.backoff.base = base
+	irs.backoff.max = max
+	irs.backoff.resetAfter = resetAfter
+	irs.backoff.jitter = jitter
+}
+
+// callback is called each time the reader is started again (not the first time)
+func (irs *InputReaderSet) SetRestartCallback(callback func(name string)) {
+	irs.Lock()
+	defer irs.Unlock()
+	irs.onRestart = callback
+}
+
 func (irs *InputReaderSet) NumRunning() int {
 	irs.RLock()
 	defer irs.RUnlock()
@@ -34,47 +100,222 @@ func (irs *InputReaderSet) NumRunning() int {
 	return ret
 }
 
-func (irs *InputReaderSet) AddInputReader(name string, ir InputReader) {
+func (irs *InputReaderSet) NumEnabled() int {
+	irs.RLock()
+	defer irs.RUnlock()
+	var ret int
+	for _, r := range irs.theSet {
+		r.Lock()
+		if r.isEnabled__() {
+			ret++
+		}
+		r.Unlock()
+	}
+	return ret
+}
+
+func (irs *InputReaderSet) EnabledNames() []string {
+	irs.RLock()
+	defer irs.RUnlock()
+	ret := make([]string, 0, len(irs.theSet))
+	for name, r := range irs.theSet {
+		r.Lock()
+		if r.isEnabled__() {
+			ret = append(ret, name)
+		}
+		r.Unlock()
+	}
+	return ret
+}
+
+// reader added again gets its old id back, so old cache entries are attributed to it.
+// Old ids of other readers are reused only after all other ids were used
+// it is to avoid attributing old cache entries to the new reader
+func (irs *InputReaderSet) allocId(name string) (byte, bool) {
+	if id, ok := irs.oldIds[name]; ok {
+		delete(irs.oldIds, name)
+		if !irs.usedIds[id] {
+			irs.usedIds[id] = true
+			return id, true
+		}
+	}
+	var old [maxNumInputReaders]bool
+	for _, id := range irs.oldIds {
+		old[id] = true
+	}
+	for _, reuseOld := range []bool{false, true} {
+		for i := 0; i < maxNumInputReaders; i++ {
+			id := (irs.nextId + i) % maxNumInputReaders
+			if irs.usedIds[id] || (old[id] && !reuseOld) {
+				continue
+			}
+			irs.usedIds[id] = true
+			irs.nextId = (id + 1) % maxNumInputReaders
+			for n, oldId := range irs.oldIds {
+				if int(oldId) == id {
+					delete(irs.oldIds, n)
+				}
+			}
+			return byte(id), true
+		}
+	}
+	return 0, false
+}
+
+// names of readers by id, including old ids of removed readers
+func (irs *InputReaderSet) IdNames() map[byte]string {
+	irs.RLock()
+	defer irs.RUnlock()
+	ret := make(map[byte]string, len(irs.theSet)+len(irs.oldIds))
+	for name, id := range irs.oldIds {
+		ret[id] = name
+	}
+	for name, r := range irs.theSet {
+		r.Lock()
+		ret[r.GetId__()] = name
+		r.Unlock()
+	}
+	return ret
+}
+
+// ids which readers had before restart. Must be called before readers are added
+func (irs *InputReaderSet) SetOldIds(ids map[string]byte) {
 	irs.Lock()
 	defer irs.Unlock()
-	_, ok := irs.theSet[name]
+	for name, id := range ids {
+		irs.oldIds[name] = id
+	}
+}
+
+func (irs *InputReaderSet) AddInputReader(name string, ir InputReader) error {
+	irs.Lock()
+	defer irs.Unlock()
+	if _, ok := irs.theSet[name]; ok {
+		return fmt.Errorf("routine set '%v': routine '%v' already exists", irs.name, name)
+	}
+	id, ok := irs.allocId(name)
 	if !ok {
-		ir.SetId__(byte(len(irs.theSet)))
-		irs.theSet[name] = ir
-		debugf("Routine set '%v': added routine '%v'", irs.name, name)
+		return fmt.Errorf("routine set '%v': can't add '%v', too many routines", irs.name, name)
 	}
+	ir.SetId__(id)
+	irs.theSet[name] = ir
+	debugf("Routine set '%v': added routine '%v'", irs.name, name)
+	return nil
+}
+
+// removes reader from the set and requests it to stop. Returns false if not found
+func (irs *InputReaderSet) RemoveInputReader(name string) bool {
+	irs.Lock()
+	defer irs.Unlock()
+	ir, ok := irs.theSet[name]
+	if !ok {
+		return false
+	}
+	delete(irs.theSet, name)
+	ir.Lock()
+	irs.usedIds[ir.GetId__()] = false
+	irs.oldIds[name] = ir.GetId__()
+	ir.setEnabled__(false)
+	ir.stop__()
+	ir.Unlock()
+	debugf("Routine set '%v': removed routine '%v'", irs.name, name)
+	return true
+}
+
+// disabled reader is stopped and not restarted until enabled again. Returns false if not found
+func (irs *InputReaderSet) SetInputReaderEnabled(name string, enabled bool) bool {
+	irs.RLock()
+	defer irs.RUnlock()
+	ir, ok := irs.theSet[name]
+	if !ok {
+		return false
+	}
+	ir.Lock()
+	defer ir.Unlock()
+	if ir.isEnabled__() == enabled {
+		return true
+	}
+	ir.setEnabled__(enabled)
+	if !enabled {
+		ir.stop__()
+	}
+	debugf("Routine set '%v': routine '%v' enabled = %v", irs.name, name, enabled)
+	return true
+}
+
+// stops running reader and restarts it only after the duration. Returns false if not found
+func (irs *InputReaderSet) PutInputReaderOnHold(name string, d time.Duration, reason ReasonNotRunning) bool {
+	irs.RLock()
+	defer irs.RUnlock()
+	ir, ok := irs.theSet[name]
+	if !ok {
+		return false
+	}
+	ir.Lock()
+	defer ir.Unlock()
+	ir.putOnHold__(d, reason)
+	debugf("Routine set '%v': routine '%v' put on hold for %v: %v", irs.name, name, d, reason)
+	return true
+}
+
+func (irs *InputReaderSet) GetInputReader(name string) (InputReader, bool) {
+	irs.RLock()
+	defer irs.RUnlock()
+	ret, ok := irs.theSet[name]
+	return ret, ok
+}
+
+// returns snapshot of readers and parameters of the set, so that the set is not locked while readers are processed
+func (irs *InputReaderSet) snapshot() (map[string]InputReader, backoffParams, func(string)) {
+	irs.RLock()
+	defer irs.RUnlock()
+	ret := make(map[string]InputReader, len(irs.theSet))
+	for name, ir := range irs.theSet {
+		ret[name] = ir
+	}
+	return ret, irs.backoff, irs.onRestart
 }
 
 func (irs *InputReaderSet) runStarter() {
+	defer irs.wg.Done()
 	debugf("---- running starter '%v'", irs.name)
 	for {
-		irs.Lock()
-		for n, r := range irs.theSet {
+		select {
+		case <-irs.ctx.Done():
+			debugf("---- stopping starter '%v'", irs.name)
+			irs.stopAll()
+			return
+		default:
+		}
+		readers, backoff, onRestart := irs.snapshot()
+		for n, r := range readers {
 			inputRoutine := r
 			name := n
 			//----------------
 			inputRoutine.Lock()
-			if !inputRoutine.isRunning__() && inputRoutine.isTimeToRestart__() {
+			if inputRoutine.isEnabled__() && !inputRoutine.isRunning__() && inputRoutine.isTimeToRestart__() {
+				isRestart := inputRoutine.wasStartedBefore__()
 				inputRoutine.setRunning__()
 				debugf("Time to run input routine %v. Go run!", name)
+				if isRestart {
+					onRestart(name)
+				}
+				irs.wg.Add(1)
 				go func() {
+					defer irs.wg.Done()
 					stopReason := inputRoutine.Run(name)
-					var restartAfter time.Duration
-					switch stopReason {
-					case REASON_NORUN_ONHOLD_10MIN:
-						restartAfter = 10 * time.Minute
-					case REASON_NORUN_ONHOLD_15MIN:
-						restartAfter = 15 * time.Minute
-					case REASON_NORUN_ONHOLD_30MIN:
-						restartAfter = 30 * time.Minute
-					case REASON_NORUN_ONHOLD_1H:
-						restartAfter = 1 * time.Hour
-					case REASON_NORUN_ERROR:
-						restartAfter = 15 * time.Second
-					default:
-						restartAfter = 1 * time.Minute
-					}
+
 					inputRoutine.Lock()
+					restartAfter := inputRoutine.nextRestartDelay__(stopReason, &backoff)
+					if holdFor, holdReason := inputRoutine.takeHold__(); holdFor > 0 {
+						restartAfter = holdFor
+						stopReason = holdReason
+					}
+					if !inputRoutine.isEnabled__() {
+						stopReason = REASON_NORUN_DISABLED
+					} else if stopReason == REASON_NORUN_DISABLED {
+						stopReason = REASON_NORUN_NONE
+					}
 					inputRoutine.setIdle__(restartAfter, stopReason)
 					inputRoutine.Unlock()
 					debugf("Stopped input routine '%v'. Will be restarted after %v", name, restartAfter)
@@ -83,8 +324,10 @@ func (irs *InputReaderSet) runStarter() {
 			inputRoutine.Unlock()
 			//---------------
 		}
-		irs.Unlock()
-		time.Sleep(10 * time.Second)
+		select {
+		case <-irs.ctx.Done():
+		case <-time.After(starterLoopPeriod):
+		}
 	}
 }
 
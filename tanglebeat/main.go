@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/unioproject/tanglebeat/lib/ebuffer"
 	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tanglebeat/inputpart"
 	"github.com/unioproject/tanglebeat/tanglebeat/inreaders"
+	"github.com/unioproject/tanglebeat/tanglebeat/outsink"
 	"github.com/unioproject/tanglebeat/tanglebeat/senderpart"
+	"github.com/unioproject/tanglebeat/tbsender/sender_update"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // TODO clean unnecessary metrics
@@ -23,39 +31,81 @@ func main() {
 
 	cfg.MustReadConfig(*pcfgfile)
 	setLogs()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := outsink.NewFeed(ctx, "/ws", cfg.Config.WsFeed.BufferSize)
 	inputpart.MustInitInputRoutines(
-		cfg.Config.IriMsgStream.OutputEnabled,
-		cfg.Config.IriMsgStream.OutputPort,
+		ctx,
+		cfg.Config.IriMsgStream.OutputSinks(),
 		cfg.Config.IriMsgStream.InputsZMQ,
-		cfg.Config.IriMsgStream.InputsNanomsg)
+		cfg.Config.IriMsgStream.InputsNanomsg,
+		feed)
+
+	senderpart.SetUpdateCallback(func(upd *sender_update.SenderUpdate) {
+		feed.PublishJSON("sender", upd)
+	})
 
 	senderpart.MustInitSenderDataCollector(
+		ctx,
 		cfg.Config.SenderMsgStream.OutputEnabled,
 		cfg.Config.SenderMsgStream.OutputPort,
 		cfg.Config.SenderMsgStream.InputsNanomsg)
 
 	initGlobStatsCollector(5)
+	go statsFeedLoop(ctx, feed, cfg.Config.WsFeed.StatsEverySec)
 	spawnCommands()
 
+	server := startWebServer(cfg.Config.WebServerPort, feed)
+
 	chInterrupt := make(chan os.Signal, 2)
-	signal.Notify(chInterrupt)
-	go func() {
-		<-chInterrupt
-		warningf("Exiting after interrupt")
-		cleanup()
-		os.Exit(0)
-	}()
-	runWebServer(cfg.Config.WebServerPort)
+	signal.Notify(chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	for sig := range chInterrupt {
+		if sig == syscall.SIGHUP {
+			reloadConfig(*pcfgfile)
+			continue
+		}
+		break
+	}
+	warningf("Exiting after interrupt")
+	if !shutdown(cancel, server) {
+		os.Exit(1)
+	}
 }
 
-func cleanup() {
+// stops everything and waits until stopped or timeout expires. Returns false on timeout
+func shutdown(cancel context.CancelFunc, server *http.Server) bool {
+	cfg.RLock()
+	timeout := time.Duration(cfg.Config.ShutdownTimeoutSec) * time.Second
+	cfg.RUnlock()
+	ctxTimeout, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
+
+	cancel()
 	killCommands()
+	if err := server.Shutdown(ctxTimeout); err != nil {
+		errorf("Web server shutdown: %v", err)
+	}
+	chDone := make(chan struct{})
+	go func() {
+		inputpart.Wait()
+		senderpart.Wait()
+		close(chDone)
+	}()
+	select {
+	case <-chDone:
+		infof("Stopped gracefully")
+		return true
+	case <-ctxTimeout.Done():
+		errorf("Failed to stop gracefully in %v", timeout)
+		return false
+	}
 }
 
 func setLogs() {
 	SetLog(cfg.GetLog(), false)
 	inreaders.SetLog(cfg.GetLog(), true)
 	inputpart.SetLog(cfg.GetLog(), false)
+	outsink.SetLog(cfg.GetLog(), false)
 	senderpart.SetLog(cfg.GetLog(), false)
 	ebuffer.SetLog(cfg.GetLog(), false)
 }
@@ -64,7 +114,10 @@ func setLogs() {
 // each command is started in the separate go routine and stdout and stderr are redirected to
 // the current output
 
-var runningCmd = make([]*exec.Cmd, 0)
+var (
+	runningCmd      = make(map[string]*exec.Cmd)
+	runningCmdMutex = &sync.Mutex{}
+)
 
 func spawnCommands() {
 	for _, cmd := range cfg.Config.SpawnCmd {
@@ -75,6 +128,13 @@ func spawnCommands() {
 func spawnCmd(cmdline string) {
 	infof("Spawning command '%v' from 'tanglebeat'", cmdline)
 
+	runningCmdMutex.Lock()
+	defer runningCmdMutex.Unlock()
+
+	if _, ok := runningCmd[cmdline]; ok {
+		errorf("Failed to run '%v' from 'tanglebeat': already running", cmdline)
+		return
+	}
 	words := strings.Split(cmdline, " ")
 	if len(words) == 0 {
 		errorf("Failed to run '%v' from 'tanglebeat': wrong cmdline '%v'", cmdline)
@@ -86,11 +146,41 @@ func spawnCmd(cmdline string) {
 	if err := cmd.Start(); err != nil {
 		errorf("Failed to run '%v' from 'tanglebeat': %v", cmdline, err)
 	} else {
-		runningCmd = append(runningCmd, cmd)
+		runningCmd[cmdline] = cmd
 	}
 }
 
+func killCommand(cmdline string) {
+	runningCmdMutex.Lock()
+	defer runningCmdMutex.Unlock()
+
+	cmd, ok := runningCmd[cmdline]
+	if !ok {
+		return
+	}
+	infof("Killing command %v %v", cmd.Path, cmd.Args)
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	delete(runningCmd, cmdline)
+}
+
+// command lines of running commands, sorted
+func runningCommands() []string {
+	runningCmdMutex.Lock()
+	defer runningCmdMutex.Unlock()
+
+	ret := make([]string, 0, len(runningCmd))
+	for cmdline := range runningCmd {
+		ret = append(ret, cmdline)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func killCommands() {
+	runningCmdMutex.Lock()
+	defer runningCmdMutex.Unlock()
+
 	for _, cmd := range runningCmd {
 		infof("Killing command %v %v", cmd.Path, cmd.Args)
 		_ = cmd.Process.Kill()
@@ -0,0 +1,233 @@
+package outsink
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feed is the WebSocket endpoint where each client subscribes to topics it needs:
+// topics of the compound stream (tx, sn, lmi, lmhs, seen), 'sender' for updates from senders
+// and 'stats' for periodic stats of the hub.
+// Topics are given in the query ('/ws?topics=sn,lmi') and changed by messages from the client
+// '{"subscribe": ["tx"]}' or '{"unsubscribe": ["tx"]}'.
+// Each message to the client is JSON '{"topic": "sn", "data": ...}', where data is the message of
+// the compound stream as a string or the JSON object for 'sender' and 'stats'.
+// Client whose buffer is full is too slow and is disconnected
+
+type Feed struct {
+	sinkBase
+	sync.Mutex
+	clients    map[*feedClient]struct{}
+	bufferSize int
+	upgrader   websocket.Upgrader
+	stopped    bool
+	chDone     chan struct{}
+}
+
+type feedClient struct {
+	ch      chan []byte
+	topics  map[string]bool
+	evicted bool
+}
+
+type feedMsg struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+type feedRequest struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+// the feed is stopped and all clients are disconnected when the context is cancelled
+func NewFeed(ctx context.Context, path string, bufferSize int) *Feed {
+	initMetrics()
+	ret := &Feed{
+		sinkBase:   newSinkBase("feed:"+path, nil),
+		clients:    make(map[*feedClient]struct{}),
+		bufferSize: utils.Max(bufferSize, 1),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		chDone: make(chan struct{}),
+	}
+	go func() {
+		<-ctx.Done()
+		ret.stop()
+		infof("Feed '%v' stopped", ret.name)
+		close(ret.chDone)
+	}()
+	infof("Feed '%v' started", ret.name)
+	return ret
+}
+
+func (f *Feed) stop() {
+	f.Lock()
+	defer f.Unlock()
+	f.stopped = true
+	for c := range f.clients {
+		close(c.ch)
+		delete(f.clients, c)
+	}
+	updateClientsGauge(f.name, 0)
+}
+
+func (f *Feed) Done() <-chan struct{} {
+	return f.chDone
+}
+
+// message of the compound stream is sent as string
+func (f *Feed) Publish(topic string, data []byte) {
+	f.publish(topic, func() interface{} { return string(data) })
+}
+
+// obj is marshalled only if someone is subscribed to the topic
+func (f *Feed) PublishJSON(topic string, obj interface{}) {
+	f.publish(topic, func() interface{} { return obj })
+}
+
+func (f *Feed) publish(topic string, getData func() interface{}) {
+	f.Lock()
+	defer f.Unlock()
+
+	var msg []byte
+	for c := range f.clients {
+		if !c.topics[topic] {
+			continue
+		}
+		if msg == nil {
+			var err error
+			msg, err = json.Marshal(&feedMsg{Topic: topic, Data: getData()})
+			if err != nil {
+				errorf("Feed '%v': %v", f.name, err)
+				return
+			}
+		}
+		select {
+		case c.ch <- msg:
+		default:
+			f.evict__(c)
+		}
+	}
+}
+
+// the writer of the client sees closed channel and disconnects
+func (f *Feed) evict__(c *feedClient) {
+	c.evicted = true
+	close(c.ch)
+	delete(f.clients, c)
+	f.drop()
+	updateEvictedCounter(f.name)
+	updateClientsGauge(f.name, len(f.clients))
+}
+
+// returns nil if the feed is stopped
+func (f *Feed) addClient(topics []string) *feedClient {
+	f.Lock()
+	defer f.Unlock()
+	if f.stopped {
+		return nil
+	}
+	ret := &feedClient{
+		ch:     make(chan []byte, f.bufferSize),
+		topics: make(map[string]bool),
+	}
+	for _, t := range topics {
+		ret.topics[t] = true
+	}
+	f.clients[ret] = struct{}{}
+	updateClientsGauge(f.name, len(f.clients))
+	return ret
+}
+
+func (f *Feed) removeClient(c *feedClient) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.clients[c]; !ok {
+		return
+	}
+	close(c.ch)
+	delete(f.clients, c)
+	updateClientsGauge(f.name, len(f.clients))
+}
+
+func (f *Feed) updateSubscription(c *feedClient, req *feedRequest) {
+	f.Lock()
+	defer f.Unlock()
+	for _, t := range req.Subscribe {
+		c.topics[t] = true
+	}
+	for _, t := range req.Unsubscribe {
+		delete(c.topics, t)
+	}
+}
+
+func (f *Feed) isEvicted(c *feedClient) bool {
+	f.Lock()
+	defer f.Unlock()
+	return c.evicted
+}
+
+func (f *Feed) Handler(w http.ResponseWriter, r *http.Request) {
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		debugf("Feed '%v': %v", f.name, err)
+		return
+	}
+	defer conn.Close()
+
+	var topics []string
+	if t := r.URL.Query().Get("topics"); t != "" {
+		topics = strings.Split(t, ",")
+	}
+	client := f.addClient(topics)
+	if client == nil {
+		return
+	}
+	defer f.removeClient(client)
+
+	chClosed := make(chan struct{})
+	go func() {
+		defer close(chClosed)
+		var req feedRequest
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			req = feedRequest{}
+			if err = json.Unmarshal(data, &req); err != nil {
+				debugf("Feed '%v': wrong request '%v': %v", f.name, string(data), err)
+				continue
+			}
+			f.updateSubscription(client, &req)
+		}
+	}()
+	for {
+		select {
+		case data, ok := <-client.ch:
+			if !ok {
+				reason := "hub is stopping"
+				if f.isEvicted(client) {
+					reason = "client is too slow"
+				}
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, reason))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-chClosed:
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package outsink
+
+import (
+	. "github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	sinkDrops   *CounterVec
+	sinkClients *GaugeVec
+	sinkEvicted *CounterVec
+	metricsOnce sync.Once
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		sinkDrops = NewCounterVec(CounterOpts{
+			Name: "tanglebeat_output_dropped_total",
+			Help: "Number of messages dropped because the output or its client was too slow, labeled by output",
+		}, []string{"sink"})
+		MustRegister(sinkDrops)
+
+		sinkClients = NewGaugeVec(GaugeOpts{
+			Name: "tanglebeat_output_clients",
+			Help: "Number of clients connected to WebSocket and SSE outputs and to the feed, labeled by output",
+		}, []string{"sink"})
+		MustRegister(sinkClients)
+
+		sinkEvicted = NewCounterVec(CounterOpts{
+			Name: "tanglebeat_output_evicted_total",
+			Help: "Number of clients of the feed disconnected because they were too slow, labeled by output",
+		}, []string{"sink"})
+		MustRegister(sinkEvicted)
+	})
+}
+
+func updateDropsCounter(sink string) {
+	sinkDrops.With(Labels{"sink": sink}).Inc()
+}
+
+func updateEvictedCounter(sink string) {
+	sinkEvicted.With(Labels{"sink": sink}).Inc()
+}
+
+func updateClientsGauge(sink string, num int) {
+	sinkClients.With(Labels{"sink": sink}).Set(float64(num))
+}
@@ -0,0 +1,228 @@
+package outsink
+
+import (
+	"context"
+	"fmt"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"strings"
+	"sync/atomic"
+)
+
+// Sink is one output transport of the stream. Publish must never block: when the sink can't keep up,
+// messages are dropped and counted
+type Sink interface {
+	Name() string
+	Publish(topic string, data []byte)
+	Drops() uint64
+	Done() <-chan struct{} // closed when the sink is stopped after the context is cancelled
+}
+
+// SinkSet publishes the same stream to all sinks
+type SinkSet struct {
+	sinks []Sink
+}
+
+// sinks are stopped when the context is cancelled. Messages already queued are sent before that.
+// Extra sinks, such as the feed, are created and stopped by the caller
+func NewSinkSet(ctx context.Context, params []cfg.OutputSinkParams, extra ...Sink) (*SinkSet, error) {
+	initMetrics()
+	ret := &SinkSet{
+		sinks: append([]Sink{}, extra...),
+	}
+	// web sinks register handlers which panic on conflicts, so everything is checked before any sink is created
+	if err := checkSinkParams(params); err != nil {
+		return nil, err
+	}
+	for i := range params {
+		sink, err := newSink(ctx, &params[i])
+		if err != nil {
+			return nil, err
+		}
+		ret.sinks = append(ret.sinks, sink)
+		infof("Output '%v' started. Topics: %v", sink.Name(), topicsStr(params[i].Topics))
+	}
+	return ret, nil
+}
+
+// paths served by the web server of the hub itself, including everything under them
+var reservedWebPaths = []string{"/ws", "/metrics", "/dashboard", "/loadjs", "/api1"}
+
+func isWebSink(params *cfg.OutputSinkParams) bool {
+	return params.Type == cfg.SinkWebSocket || params.Type == cfg.SinkSSE
+}
+
+func sinkName(params *cfg.OutputSinkParams) string {
+	if isWebSink(params) {
+		return fmt.Sprintf("%v:%v", params.Type, params.Path)
+	}
+	return fmt.Sprintf("%v:%v", params.Type, params.Port)
+}
+
+func checkSinkParams(params []cfg.OutputSinkParams) error {
+	names := make(map[string]bool)
+	paths := make(map[string]string)
+	for i := range params {
+		p := &params[i]
+		name := sinkName(p)
+		if names[name] {
+			return fmt.Errorf("output '%v' is configured twice", name)
+		}
+		names[name] = true
+		if !isWebSink(p) {
+			continue
+		}
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("output '%v': path must start with '/'", name)
+		}
+		for _, reserved := range reservedWebPaths {
+			if p.Path == reserved || strings.HasPrefix(p.Path, reserved+"/") {
+				return fmt.Errorf("output '%v': path '%v' is used by the hub", name, p.Path)
+			}
+		}
+		if other, ok := paths[p.Path]; ok {
+			return fmt.Errorf("outputs '%v' and '%v' have the same path", other, name)
+		}
+		paths[p.Path] = name
+	}
+	return nil
+}
+
+func newSink(ctx context.Context, params *cfg.OutputSinkParams) (Sink, error) {
+	switch params.Type {
+	case cfg.SinkZMQ:
+		return newZmqSink(ctx, params)
+	case cfg.SinkNanomsg:
+		return newNanomsgSink(ctx, params)
+	case cfg.SinkWebSocket:
+		return newWebSocketSink(ctx, params)
+	case cfg.SinkSSE:
+		return newSSESink(ctx, params)
+	}
+	return nil, fmt.Errorf("unknown output type '%v'", params.Type)
+}
+
+func (set *SinkSet) Publish(topic string, data []byte) {
+	for _, s := range set.sinks {
+		s.Publish(topic, data)
+	}
+}
+
+func (set *SinkSet) Sinks() []Sink {
+	return set.sinks
+}
+
+// waits until all sinks are stopped
+func (set *SinkSet) Wait() {
+	for _, s := range set.sinks {
+		<-s.Done()
+	}
+}
+
+// name and topic filter common for all sinks
+type sinkBase struct {
+	name   string
+	topics map[string]bool // nil means all topics
+	drops  uint64
+}
+
+func newSinkBase(name string, topics []string) sinkBase {
+	ret := sinkBase{name: name}
+	if len(topics) > 0 {
+		ret.topics = make(map[string]bool)
+		for _, t := range topics {
+			ret.topics[t] = true
+		}
+	}
+	return ret
+}
+
+func (s *sinkBase) Name() string {
+	return s.name
+}
+
+func (s *sinkBase) accepts(topic string) bool {
+	return s.topics == nil || s.topics[topic]
+}
+
+func (s *sinkBase) drop() {
+	atomic.AddUint64(&s.drops, 1)
+	updateDropsCounter(s.name)
+}
+
+func (s *sinkBase) Drops() uint64 {
+	return atomic.LoadUint64(&s.drops)
+}
+
+func topicsStr(topics []string) string {
+	if len(topics) == 0 {
+		return "all"
+	}
+	return fmt.Sprintf("%v", topics)
+}
+
+// queueSink sends messages to the socket from its own buffered queue, so the slow socket does not
+// block the filter. When the context is cancelled, messages left in the queue are sent and the socket is closed
+type queueSink struct {
+	sinkBase
+	chIn      chan []byte
+	send      func(data []byte) error
+	closeSock func()
+	chDone    chan struct{}
+}
+
+func newQueueSink(ctx context.Context, name string, params *cfg.OutputSinkParams, send func([]byte) error, closeSock func()) *queueSink {
+	ret := &queueSink{
+		sinkBase:  newSinkBase(name, params.Topics),
+		chIn:      make(chan []byte, utils.Max(params.BufferSize, 1)),
+		send:      send,
+		closeSock: closeSock,
+		chDone:    make(chan struct{}),
+	}
+	go func() {
+		ret.loop(ctx)
+		ret.closeSock()
+		infof("Output '%v' stopped", ret.name)
+		close(ret.chDone)
+	}()
+	return ret
+}
+
+func (s *queueSink) loop(ctx context.Context) {
+	for {
+		select {
+		case data := <-s.chIn:
+			s.sendData(data)
+		case <-ctx.Done():
+			for {
+				select {
+				case data := <-s.chIn:
+					s.sendData(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *queueSink) sendData(data []byte) {
+	if err := s.send(data); err != nil {
+		errorf("Output '%v': %v", s.name, err)
+	}
+}
+
+func (s *queueSink) Publish(topic string, data []byte) {
+	if !s.accepts(topic) {
+		return
+	}
+	select {
+	case s.chIn <- data:
+	default:
+		s.drop()
+	}
+}
+
+func (s *queueSink) Done() <-chan struct{} {
+	return s.chDone
+}
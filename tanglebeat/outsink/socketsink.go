@@ -0,0 +1,46 @@
+package outsink
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-zeromq/zmq4"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"nanomsg.org/go-mangos/protocol/pub"
+	"nanomsg.org/go-mangos/transport/tcp"
+)
+
+// native ZMQ PUB socket. Messages are single frames, same as of IRI, so IRI-compatible tools
+// can subscribe to the hub directly
+func newZmqSink(ctx context.Context, params *cfg.OutputSinkParams) (Sink, error) {
+	sock := zmq4.NewPub(context.Background())
+	url := fmt.Sprintf("tcp://*:%v", params.Port)
+	if err := sock.Listen(url); err != nil {
+		_ = sock.Close()
+		return nil, fmt.Errorf("can't listen ZMQ pub socket on %v: %v", url, err)
+	}
+	send := func(data []byte) error {
+		return sock.Send(zmq4.NewMsg(data))
+	}
+	closeSock := func() {
+		_ = sock.Close()
+	}
+	return newQueueSink(ctx, sinkName(params), params, send, closeSock), nil
+}
+
+// mangos PUB socket, same as the output of previous versions
+func newNanomsgSink(ctx context.Context, params *cfg.OutputSinkParams) (Sink, error) {
+	sock, err := pub.NewSocket()
+	if err != nil {
+		return nil, fmt.Errorf("can't create Nanomsg pub socket: %v", err)
+	}
+	sock.AddTransport(tcp.NewTransport())
+	url := fmt.Sprintf("tcp://:%v", params.Port)
+	if err = sock.Listen(url); err != nil {
+		_ = sock.Close()
+		return nil, fmt.Errorf("can't listen Nanomsg pub socket on %v: %v", url, err)
+	}
+	closeSock := func() {
+		_ = sock.Close()
+	}
+	return newQueueSink(ctx, sinkName(params), params, sock.Send, closeSock), nil
+}
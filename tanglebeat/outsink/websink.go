@@ -0,0 +1,258 @@
+package outsink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/unioproject/tanglebeat/lib/utils"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocket and Server-Sent Events sinks are served by the web server of the hub.
+// Each client has its own buffer. If the buffer of the client is full, the message is dropped
+// for that client only, so the slow browser doesn't affect others
+
+const webWriteTimeout = 10 * time.Second
+
+type webClient struct {
+	ch     chan []byte
+	accept func(ev interface{}) bool // filter of events of the event stream, nil for sinks
+}
+
+type webSink struct {
+	sinkBase
+	sync.Mutex
+	clients    map[*webClient]struct{}
+	bufferSize int
+	stopped    bool
+	chDone     chan struct{}
+}
+
+func newWebSink(ctx context.Context, typ string, params *cfg.OutputSinkParams) *webSink {
+	ret := &webSink{
+		sinkBase:   newSinkBase(fmt.Sprintf("%v:%v", typ, params.Path), params.Topics),
+		clients:    make(map[*webClient]struct{}),
+		bufferSize: utils.Max(params.BufferSize, 1),
+		chDone:     make(chan struct{}),
+	}
+	go func() {
+		<-ctx.Done()
+		ret.stop()
+		infof("Output '%v' stopped", ret.name)
+		close(ret.chDone)
+	}()
+	return ret
+}
+
+// all clients are disconnected
+func (s *webSink) stop() {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = true
+	for c := range s.clients {
+		close(c.ch)
+		delete(s.clients, c)
+	}
+	updateClientsGauge(s.name, 0)
+}
+
+// returns nil if the sink is stopped
+func (s *webSink) addClient(accept func(ev interface{}) bool) *webClient {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return nil
+	}
+	ret := &webClient{ch: make(chan []byte, s.bufferSize), accept: accept}
+	s.clients[ret] = struct{}{}
+	updateClientsGauge(s.name, len(s.clients))
+	return ret
+}
+
+func (s *webSink) removeClient(c *webClient) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	close(c.ch)
+	delete(s.clients, c)
+	updateClientsGauge(s.name, len(s.clients))
+}
+
+func (s *webSink) Publish(topic string, data []byte) {
+	if !s.accepts(topic) {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.clients {
+		select {
+		case c.ch <- data:
+		default:
+			s.drop()
+		}
+	}
+}
+
+func (s *webSink) Done() <-chan struct{} {
+	return s.chDone
+}
+
+type webSocketSink struct {
+	*webSink
+	upgrader websocket.Upgrader
+}
+
+// each message is sent as a text message
+func newWebSocketSink(ctx context.Context, params *cfg.OutputSinkParams) (Sink, error) {
+	ret := &webSocketSink{
+		webSink: newWebSink(ctx, cfg.SinkWebSocket, params),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	http.HandleFunc(params.Path, ret.handler)
+	return ret, nil
+}
+
+func (s *webSocketSink) handler(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		debugf("Output '%v': %v", s.name, err)
+		return
+	}
+	defer conn.Close()
+
+	client := s.addClient(nil)
+	if client == nil {
+		return
+	}
+	defer s.removeClient(client)
+
+	// messages from the client are not expected. Reading is needed to process control frames and to
+	// find out when the client disconnects
+	chClosed := make(chan struct{})
+	go func() {
+		defer close(chClosed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case data, ok := <-client.ch:
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "hub is stopping"))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-chClosed:
+			return
+		}
+	}
+}
+
+type sseSink struct {
+	*webSink
+}
+
+// each message is sent as the 'data' field of the event
+func newSSESink(ctx context.Context, params *cfg.OutputSinkParams) (Sink, error) {
+	ret := &sseSink{
+		webSink: newWebSink(ctx, cfg.SinkSSE, params),
+	}
+	http.HandleFunc(params.Path, ret.handler)
+	return ret, nil
+}
+
+func (s *sseSink) handler(w http.ResponseWriter, r *http.Request) {
+	s.serveSSE(w, r, nil)
+}
+
+func (s *webSink) serveSSE(w http.ResponseWriter, r *http.Request, accept func(ev interface{}) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	client := s.addClient(accept)
+	if client == nil {
+		http.Error(w, "hub is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.removeClient(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		select {
+		case data, ok := <-client.ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// EventStream sends JSON events to SSE clients. Each client receives events accepted by its own filter
+type EventStream struct {
+	*webSink
+}
+
+// the stream is not a sink of the output stream, the handler is registered by the caller
+func NewEventStream(ctx context.Context, name string, bufferSize int) *EventStream {
+	initMetrics()
+	return &EventStream{
+		webSink: newWebSink(ctx, cfg.SinkSSE, &cfg.OutputSinkParams{Path: name, BufferSize: bufferSize}),
+	}
+}
+
+// event is marshalled once for all clients
+func (es *EventStream) PublishEvent(ev interface{}) {
+	es.Lock()
+	defer es.Unlock()
+
+	var data []byte
+	for c := range es.clients {
+		if c.accept != nil && !c.accept(ev) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(ev); err != nil {
+				errorf("Event stream '%v': %v", es.name, err)
+				return
+			}
+		}
+		select {
+		case c.ch <- data:
+		default:
+			es.drop()
+		}
+	}
+}
+
+// accept == nil means all events
+func (es *EventStream) Serve(w http.ResponseWriter, r *http.Request, accept func(ev interface{}) bool) {
+	es.serveSSE(w, r, accept)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
+	"github.com/unioproject/tanglebeat/tanglebeat/inputpart"
+)
+
+// re-reads config file upon SIGHUP and applies changes which can be applied without restart
+
+func reloadConfig(cfgfile string) {
+	infof("Reloading config file '%v'", cfgfile)
+	changes, err := cfg.ReloadConfig(cfgfile, runningLists())
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
+	// removed first, so the input moved between inputsZMQ and inputsNanomsg is re-created
+	for _, uri := range changes.InputsZMQRemoved {
+		if err = inputpart.RemoveInput(uri); err != nil {
+			errorf("Reload config: %v", err)
+		}
+	}
+	for _, uri := range changes.InputsNanomsgRemoved {
+		if err = inputpart.RemoveInput(uri); err != nil {
+			errorf("Reload config: %v", err)
+		}
+	}
+	for _, uri := range changes.InputsZMQAdded {
+		if err = inputpart.AddInput(uri, "zmq"); err != nil {
+			errorf("Reload config: %v", err)
+		}
+	}
+	for _, uri := range changes.InputsNanomsgAdded {
+		if err = inputpart.AddInput(uri, "nanomsg"); err != nil {
+			errorf("Reload config: %v", err)
+		}
+	}
+	for _, cmdline := range changes.SpawnCmdRemoved {
+		killCommand(cmdline)
+	}
+	for _, cmdline := range changes.SpawnCmdAdded {
+		spawnCmd(cmdline)
+	}
+	// inputs and commands which failed to change are retried on the next reload
+	cfg.SetRunningLists(runningLists())
+	for _, s := range changes.Applied {
+		infof("Reload config: applied %v", s)
+	}
+	if len(changes.Applied) > 0 {
+		inputpart.CheckQuorums()
+	}
+	for _, s := range changes.RestartRequired {
+		warningf("Reload config: parameter '%v' was changed. Restart required", s)
+	}
+	infof("Reloaded config file '%v'", cfgfile)
+}
+
+func runningLists() *cfg.RunningLists {
+	ret := &cfg.RunningLists{SpawnCmd: runningCommands()}
+	ret.InputsZMQ, ret.InputsNanomsg = inputpart.InputUris()
+	return ret
+}
@@ -2,6 +2,7 @@ package senderpart
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tbsender/sender_update"
 )
 
@@ -12,9 +13,15 @@ var (
 	confPoWDurationSecCounter    *prometheus.CounterVec
 	confTipselDurationSecCounter *prometheus.CounterVec
 	//restartCounter               prometheus.Counter
+
+	confDurationHistogram   *prometheus.HistogramVec
+	powDurationHistogram    *prometheus.HistogramVec
+	tipselDurationHistogram *prometheus.HistogramVec
 )
 
-func init() {
+// buckets are taken from the config, so metrics are created after the config is read.
+// Duration counters are legacy: same sums are in histograms
+func initSenderMetrics() {
 	confCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "tanglebeat_confirmation_counter",
 		Help: "Increases every time sender confirms a transfer",
@@ -40,15 +47,38 @@ func init() {
 		Help: "Sums up total duration it took to do tip selection for confirmation.",
 	}, []string{"seqid", "node_tipsel"})
 
+	confDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tanglebeat_confirmation_duration_seconds",
+		Help:    "Confirmation durations of transfers.",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramConfirmation],
+	}, []string{"seqid"})
+
+	powDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tanglebeat_pow_duration_seconds",
+		Help:    "Total duration of PoW for confirmation of the transfer.",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramPoW],
+	}, []string{"seqid", "node_pow"})
+
+	tipselDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tanglebeat_tipsel_duration_seconds",
+		Help:    "Total duration of tip selection for confirmation of the transfer.",
+		Buckets: cfg.Config.Histograms.Buckets[cfg.HistogramTipsel],
+	}, []string{"seqid", "node_tipsel"})
+
 	//restartCounter = prometheus.NewCounter(prometheus.CounterOpts{
 	//	Name: "tanglebeat_restart_counter",
 	//	Help: "Increases every time program starts",
 	//})
 	prometheus.MustRegister(confCounter)
-	prometheus.MustRegister(confDurationSecCounter)
 	prometheus.MustRegister(confPoWCostCounter)
-	prometheus.MustRegister(confPoWDurationSecCounter)
-	prometheus.MustRegister(confTipselDurationSecCounter)
+	prometheus.MustRegister(confDurationHistogram)
+	prometheus.MustRegister(powDurationHistogram)
+	prometheus.MustRegister(tipselDurationHistogram)
+	if !cfg.Config.Histograms.LegacyGaugesDisabled {
+		prometheus.MustRegister(confDurationSecCounter)
+		prometheus.MustRegister(confPoWDurationSecCounter)
+		prometheus.MustRegister(confTipselDurationSecCounter)
+	}
 	//prometheus.MustRegister(restartCounter)
 }
 
@@ -72,23 +102,42 @@ func updateSenderMetrics(upd *sender_update.SenderUpdate) {
 
 	confCounter.With(prometheus.Labels{"seqid": upd.SeqUID}).Inc()
 
-	durSec := float64(upd.UpdateTs-upd.StartTs) / 1000
-	confDurationSecCounter.
-		With(prometheus.Labels{"seqid": upd.SeqUID}).Add(durSec)
-
 	powCost := float64(upd.NumAttaches*upd.BundleSize + upd.NumPromotions*upd.PromoBundleSize)
 	confPoWCostCounter.
 		With(prometheus.Labels{"seqid": upd.SeqUID}).Add(powCost)
 
+	durSec := float64(upd.UpdateTs-upd.StartTs) / 1000
+	powSec := float64(upd.TotalPoWMsec) / 1000
+	tipselSec := float64(upd.TotalTipselMsec) / 1000
+
+	confDurationHistogram.
+		With(prometheus.Labels{"seqid": upd.SeqUID}).Observe(durSec)
+	powDurationHistogram.
+		With(prometheus.Labels{
+			"seqid":    upd.SeqUID,
+			"node_pow": upd.NodePOW,
+		}).Observe(powSec)
+	tipselDurationHistogram.
+		With(prometheus.Labels{
+			"seqid":       upd.SeqUID,
+			"node_tipsel": upd.NodeTipsel,
+		}).Observe(tipselSec)
+
+	if cfg.Config.Histograms.LegacyGaugesDisabled {
+		return
+	}
+	confDurationSecCounter.
+		With(prometheus.Labels{"seqid": upd.SeqUID}).Add(durSec)
+
 	confPoWDurationSecCounter.
 		With(prometheus.Labels{
 			"seqid":    upd.SeqUID,
 			"node_pow": upd.NodePOW,
-		}).Add(float64(upd.TotalPoWMsec) / 1000)
+		}).Add(powSec)
 
 	confTipselDurationSecCounter.
 		With(prometheus.Labels{
 			"seqid":       upd.SeqUID,
 			"node_tipsel": upd.NodeTipsel,
-		}).Add(float64(upd.TotalTipselMsec) / 1000)
+		}).Add(tipselSec)
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/unioproject/tanglebeat/tbsender/sender_update"
 	"math"
 	"net/http"
+	"net/url"
 	"sort"
 	"sync"
 	"time"
@@ -39,8 +40,32 @@ type confTimeDataStruct struct {
 	Percentile80 float64 `json:"p80"`
 }
 
+// JSON returned by the stats WS when filtered by sequence, PoW node or time window.
+// 'all' is for all samples which pass filters, 'bySeqid' is breakdown of the same samples by sequence
+type filteredStatsResponse struct {
+	Nowis   uint64                        `json:"nowis"`
+	Window  string                        `json:"window"`
+	SeqID   string                        `json:"seqid,omitempty"`
+	NodePoW string                        `json:"nodePow,omitempty"`
+	All     confTimeDataStruct            `json:"all"`
+	BySeqID map[string]confTimeDataStruct `json:"bySeqid"`
+}
+
+// confirmation duration with sequence and PoW node it was made by
+type confSample struct {
+	seqid      string
+	nodePoW    string
+	durationMs int
+}
+
+// samples are kept longer than the longest fixed window to serve arbitrary windows
+const (
+	confSamplesSegmentDurationSec = 10 * 60
+	confSamplesRetentionSec       = 24 * 60 * 60
+)
+
 var (
-	sampleDurations   *ebuffer.EventTsWithIntExpiringBuffer
+	confSamples       *ebuffer.EventTsWithDataExpiringBuffer
 	confTimeData10min confTimeDataStruct
 	confTimeData30min confTimeDataStruct
 	confTimeData1h    confTimeDataStruct
@@ -48,7 +73,8 @@ var (
 )
 
 func init() {
-	sampleDurations = ebuffer.NewEventTsWithIntExpiringBuffer("sampleDurations", 10*60, 60*60)
+	confSamples = ebuffer.NewEventTsWithDataExpiringBuffer(
+		"confSamples", confSamplesSegmentDurationSec, confSamplesRetentionSec)
 	confTimeDataMutex = &sync.RWMutex{}
 	go calcStatsLoop()
 }
@@ -56,18 +82,51 @@ func init() {
 func calcStatsLoop() {
 	for {
 		confTimeDataMutex.Lock()
-		calcStats(10*60*1000, &confTimeData10min)
-		calcStats(30*60*1000, &confTimeData30min)
-		calcStats(60*60*1000, &confTimeData1h)
+		calcStatsBack(10*60*1000, &confTimeData10min)
+		calcStatsBack(30*60*1000, &confTimeData30min)
+		calcStatsBack(60*60*1000, &confTimeData1h)
 		confTimeDataMutex.Unlock()
 
 		time.Sleep(5 * time.Second)
 	}
 }
 
-func calcStats(msecAgo uint64, ret *confTimeDataStruct) {
-	var arr []float64
-	arr, ret.Since = sampleDurations.ToFloat64(msecAgo)
+// durations of samples in milliseconds and time of the earliest of them
+type durations struct {
+	arr   []float64
+	since uint64
+}
+
+func newDurations() *durations {
+	return &durations{arr: make([]float64, 0), since: utils.UnixMsNow()}
+}
+
+func (d *durations) add(ts uint64, s *confSample) {
+	d.arr = append(d.arr, float64(s.durationMs))
+	if ts < d.since {
+		d.since = ts
+	}
+}
+
+// samples not older than msecAgo which are accepted by the filter (nil means all)
+func forEachSample(msecAgo uint64, accept func(s *confSample) bool, callback func(ts uint64, s *confSample)) {
+	confSamples.ForEachEntry(func(ts uint64, data interface{}) bool {
+		s := data.(*confSample)
+		if accept == nil || accept(s) {
+			callback(ts, s)
+		}
+		return true
+	}, utils.UnixMsNow()-msecAgo, true)
+}
+
+func calcStatsBack(msecAgo uint64, ret *confTimeDataStruct) {
+	d := newDurations()
+	forEachSample(msecAgo, nil, d.add)
+	calcStats(d.arr, d.since, ret)
+}
+
+func calcStats(arr []float64, since uint64, ret *confTimeDataStruct) {
+	ret.Since = since
 	if len(arr) == 0 {
 		*ret = confTimeDataStruct{}
 		return
@@ -99,10 +158,49 @@ func calcStats(msecAgo uint64, ret *confTimeDataStruct) {
 	ret.Percentile80 = math.Round(ret.Percentile80/10) / 100
 }
 
+// GET /api1/conf_time[?seqid=<seqid>][&node_pow=<node>][&window=<duration, for example 2h or 90m>]
+// without any of these parameters stats for fixed windows 10min, 30min and 1h are returned.
+// Other parameters (for example cache busters) are ignored
+
+func isFilteredStatsQuery(q url.Values) bool {
+	for _, name := range []string{"seqid", "node_pow", "window"} {
+		if _, ok := q[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func HandlerConfStats(w http.ResponseWriter, r *http.Request) {
 	debugf("%v: Request get_stats %v from %v\n", time.Now().Format(time.RFC3339), r.RequestURI, r.RemoteAddr)
 
-	resp := statsResponse{}
+	var resp interface{}
+	if !isFilteredStatsQuery(r.URL.Query()) {
+		resp = getFixedWindowStats()
+	} else {
+		window := time.Hour
+		if s := r.URL.Query().Get("window"); s != "" {
+			var err error
+			window, err = time.ParseDuration(s)
+			if err != nil || window <= 0 || window > confSamplesRetentionSec*time.Second {
+				http.Error(w, fmt.Sprintf("wrong window '%v', expected duration up to %v",
+					s, confSamplesRetentionSec*time.Second), http.StatusBadRequest)
+				return
+			}
+		}
+		resp = getFilteredStats(window, r.URL.Query().Get("seqid"), r.URL.Query().Get("node_pow"))
+	}
+
+	data, err := json.MarshalIndent(resp, "", "   ")
+	if err == nil {
+		_, _ = w.Write(data)
+	} else {
+		_, _ = fmt.Fprintf(w, "Error while marshaling stats response: %v\n", err)
+	}
+}
+
+func getFixedWindowStats() *statsResponse {
+	resp := &statsResponse{}
 
 	confTimeDataMutex.RLock()
 	resp.Last10min = confTimeData10min
@@ -110,18 +208,49 @@ func HandlerConfStats(w http.ResponseWriter, r *http.Request) {
 	resp.Last1h = confTimeData1h
 	confTimeDataMutex.RUnlock()
 	resp.Nowis = utils.UnixMsNow()
+	return resp
+}
 
-	data, err := json.MarshalIndent(resp, "", "   ")
-	if err == nil {
-		_, _ = w.Write(data)
-	} else {
-		_, _ = fmt.Fprintf(w, "Error while marshaling stats response: %v\n", err)
+// empty seqid or nodePoW means any
+func getFilteredStats(window time.Duration, seqid, nodePoW string) *filteredStatsResponse {
+	resp := &filteredStatsResponse{
+		Window:  window.String(),
+		SeqID:   seqid,
+		NodePoW: nodePoW,
+		BySeqID: make(map[string]confTimeDataStruct),
 	}
+	accept := func(s *confSample) bool {
+		return (seqid == "" || s.seqid == seqid) && (nodePoW == "" || s.nodePoW == nodePoW)
+	}
+	all := newDurations()
+	bySeqID := make(map[string]*durations)
+	forEachSample(uint64(window/time.Millisecond), accept, func(ts uint64, s *confSample) {
+		all.add(ts, s)
+		d, ok := bySeqID[s.seqid]
+		if !ok {
+			d = newDurations()
+			bySeqID[s.seqid] = d
+		}
+		d.add(ts, s)
+	})
+
+	calcStats(all.arr, all.since, &resp.All)
+	for id, d := range bySeqID {
+		var st confTimeDataStruct
+		calcStats(d.arr, d.since, &st)
+		resp.BySeqID[id] = st
+	}
+	resp.Nowis = utils.UnixMsNow()
+	return resp
 }
 
 func senderUpdateToStats(upd *sender_update.SenderUpdate) {
 	if upd.UpdType == sender_update.SENDER_UPD_CONFIRM {
-		sampleDurations.RecordInt(int(upd.UpdateTs) - int(upd.StartTs))
+		confSamples.RecordTS(&confSample{
+			seqid:      upd.SeqUID,
+			nodePoW:    upd.NodePOW,
+			durationMs: int(upd.UpdateTs) - int(upd.StartTs),
+		})
 	}
 }
 
@@ -1,6 +1,7 @@
 package senderpart
 
 import (
+	"context"
 	"fmt"
 	"github.com/unioproject/tanglebeat/lib/nanomsg"
 	"github.com/unioproject/tanglebeat/tanglebeat/hashcache"
@@ -28,16 +29,31 @@ var (
 	senderUpdateSources *inreaders.InputReaderSet
 	senderOutPublisher  *nanomsg.Publisher
 	publishedUpdates    *hashcache.HashCacheBase
+	onUpdate            = func(upd *sender_update.SenderUpdate) {}
 )
 
-func MustInitSenderDataCollector(outEnabled bool, outPort int, inputs []string) {
+// callback is called for each new update. Must be set before the collector is started
+func SetUpdateCallback(callback func(upd *sender_update.SenderUpdate)) {
+	onUpdate = callback
+}
+
+// when the context is cancelled update sources are stopped, then the publisher
+func MustInitSenderDataCollector(ctx context.Context, outEnabled bool, outPort int, inputs []string) {
+	initSenderMetrics()
 	publishedUpdates = hashcache.NewHashCacheBase(
 		"publishedUpdates", 0, 10*60, 60*60)
-	senderUpdateSources = inreaders.NewInputReaderSet("sender update routine set")
+	senderUpdateSources = inreaders.NewInputReaderSet(ctx, "sender update routine set")
 
+	// publisher is stopped only after all sources are stopped, so that nothing is left unpublished
+	ctxPublisher, cancelPublisher := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+		senderUpdateSources.Wait()
+		cancelPublisher()
+	}()
 	if outEnabled {
 		var err error
-		senderOutPublisher, err = nanomsg.NewPublisher(outEnabled, outPort, 0, localLog)
+		senderOutPublisher, err = nanomsg.NewPublisher(ctxPublisher, outEnabled, outPort, 0, localLog)
 		if err != nil {
 			errorf("Failed to create sender output publishing channel: %v", err)
 			panic(err)
@@ -51,6 +67,14 @@ func MustInitSenderDataCollector(outEnabled bool, outPort int, inputs []string)
 	}
 }
 
+// waits until update sources and the publisher are stopped after the context was cancelled
+func Wait() {
+	senderUpdateSources.Wait()
+	if senderOutPublisher != nil {
+		<-senderOutPublisher.Done()
+	}
+}
+
 func (r *updateSource) GetUri() string {
 	r.Lock()
 	defer r.Unlock()
@@ -62,7 +86,16 @@ func (r *updateSource) Run(name string) inreaders.ReasonNotRunning {
 	infof("Starting sender update source '%v' at '%v'", name, uri)
 	defer errorf("Leaving sender update source '%v' at '%v'", name, uri)
 
-	chIn, err := sender_update.NewUpdateChan(uri)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.GetStopChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	chIn, err := sender_update.NewUpdateChan(ctx, uri)
 	if err != nil {
 		errorf("failed to initialize sender update source for %v: %v", uri, err)
 		return inreaders.REASON_NORUN_ERROR
@@ -77,6 +110,9 @@ func (r *updateSource) Run(name string) inreaders.ReasonNotRunning {
 			return inreaders.REASON_NORUN_ONHOLD_10MIN
 		}
 	}
+	if r.IsStopRequested() {
+		return inreaders.REASON_NORUN_DISABLED
+	}
 	return inreaders.REASON_NORUN_ONHOLD_10MIN
 }
 
@@ -97,6 +133,7 @@ func (r *updateSource) processUpdate(upd *sender_update.SenderUpdate) error {
 	if upd.UpdType == sender_update.SENDER_UPD_PROMOTE && len(upd.PromoTail) != 0 {
 		inputpart.TxSentForEcho(upd.PromoTail, upd.UpdateTs)
 	}
+	onUpdate(upd)
 
 	if senderOutPublisher != nil {
 		if upd.UpdType == sender_update.SENDER_UPD_CONFIRM {
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/unioproject/tanglebeat/lib/utils"
 	"github.com/unioproject/tanglebeat/tanglebeat/cfg"
 	"github.com/unioproject/tanglebeat/tanglebeat/inputpart"
+	"github.com/unioproject/tanglebeat/tanglebeat/outsink"
 	"math"
 	"net"
 	"net/url"
@@ -20,6 +22,7 @@ type GlbStats struct {
 	QuorumTX            int                            `json:"quorumTX"`
 	QuorumSN            int                            `json:"quorumSN"`
 	QuorumLMI           int                            `json:"quorumLMI"`
+	RestartRequired     []string                       `json:"restartRequired"`
 	GoRuntimeStats      memStatsStruct                 `json:"goRuntimeStats"`
 	ZmqCacheStats       inputpart.ZmqCacheStatsStruct  `json:"zmqRuntimeStats"`
 	ZmqOutputStats      inputpart.ZmqOutputStatsStruct `json:"zmqOutputStats"`
@@ -69,6 +72,7 @@ func updateGlbStatsLoop(refreshStatsEverySec int) {
 		glbStats.QuorumTX = inputpart.GetTxQuorum()
 		glbStats.QuorumSN = inputpart.GetSnQuorum()
 		glbStats.QuorumLMI = inputpart.GetLmiQuorum()
+		glbStats.RestartRequired = cfg.GetRestartRequired()
 
 		glbStats.mutex.Unlock()
 
@@ -133,3 +137,17 @@ func getMaskedGlbStats(maskIP bool, hideInactive bool) *GlbStats {
 	ret.ZmqInputStats = maskedInputs
 	return &ret
 }
+
+// stats are sent to subscribers of the feed as they are shown on the dashboard
+func statsFeedLoop(ctx context.Context, feed *outsink.Feed, everySec int) {
+	ticker := time.NewTicker(time.Duration(everySec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			feed.PublishJSON("stats", json.RawMessage(getGlbStatsJSON(false, true, false)))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -3,20 +3,36 @@ package main
 import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/unioproject/tanglebeat/tanglebeat/inputpart"
+	"github.com/unioproject/tanglebeat/tanglebeat/outsink"
 	"github.com/unioproject/tanglebeat/tanglebeat/senderpart"
 	"net/http"
 	"strings"
 )
 
-func runWebServer(port int) {
+// returns server running in the background
+func startWebServer(port int, feed *outsink.Feed) *http.Server {
 	infof("Web server for Prometheus metrics and debug dashboard will be running on port '%d'", port)
 	http.HandleFunc("/loadjs", loadjsHandler)
 	http.HandleFunc("/dashboard", dashboardHandler)
 	http.HandleFunc("/api1/internal_stats/", internalStatsHandler)
+	http.HandleFunc("/api1/inputs", inputpart.HandlerInputs)
+	http.HandleFunc("/api1/inputs/", inputpart.HandlerInputs)
+	http.HandleFunc("/api1/seenby/", inputpart.HandlerSeenBy)
+	http.HandleFunc("/api1/bundles", inputpart.HandlerBundles)
+	http.HandleFunc("/api1/bundles/", inputpart.HandlerBundles)
+	http.HandleFunc("/api1/stream/transfers", inputpart.HandlerTransferStream)
 	http.HandleFunc("/api1/conf_time", senderpart.HandlerConfStats)
 	http.HandleFunc("/api1/senders", senderpart.HandlerSenderStates)
+	http.HandleFunc("/ws", feed.Handler)
 	http.Handle("/metrics", promhttp.Handler())
-	panic(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	return server
 }
 
 func internalStatsHandler(w http.ResponseWriter, r *http.Request) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/unioproject/tanglebeat/lib/nanomsg"
 )
 
@@ -8,7 +9,7 @@ var updatePublisher *nanomsg.Publisher
 
 func mustInitAndRunPublisher() {
 	var err error
-	updatePublisher, err = nanomsg.NewPublisher(
+	updatePublisher, err = nanomsg.NewPublisher(context.Background(),
 		Config.SenderUpdatePublisher.Enabled, Config.SenderUpdatePublisher.OutputPort, 0, log)
 	if err != nil {
 		log.Errorf("Failed to create publishing channel: %v", err)
@@ -1,6 +1,7 @@
 package sender_update
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,8 +12,9 @@ import (
 )
 
 // uri must be like "tcp://my.host:3100"
+// When the context is cancelled, the socket is closed and the channel is closed
 
-func NewUpdateChan(uri string) (chan *SenderUpdate, error) {
+func NewUpdateChan(ctx context.Context, uri string) (chan *SenderUpdate, error) {
 	var sock mangos.Socket
 	var err error
 
@@ -32,14 +34,26 @@ func NewUpdateChan(uri string) (chan *SenderUpdate, error) {
 	var msg []byte
 	var upd *SenderUpdate
 	go func() {
-		defer sock.Close()
+		// closing the socket is the only way to interrupt blocking Recv
+		<-ctx.Done()
+		_ = sock.Close()
+	}()
+	go func() {
+		defer close(chOut)
 		for {
 			msg, err = sock.Recv()
+			if ctx.Err() != nil {
+				return
+			}
 			if err == nil {
 				upd = &SenderUpdate{}
 				err = json.Unmarshal(msg, &upd)
 				if err == nil {
-					chOut <- upd
+					select {
+					case chOut <- upd:
+					case <-ctx.Done():
+						return
+					}
 				} else {
 					fmt.Printf("Error while unmarshaling sender update from %v: %v\n", uri, err)
 					time.Sleep(5 * time.Second)